@@ -1,8 +1,10 @@
 package buildkite
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"path"
 	"strconv"
 	"strings"
@@ -13,16 +15,29 @@ import (
 
 const pollDuration = time.Second * 5
 
+const defaultMaxPages = 10
+
 type Session struct {
-	Org    string
+	Org string
+
+	// MaxPages caps how many pages of builds are listed per query, defaulting
+	// to 10
+	MaxPages int
+
 	client *buildkite.Client
 }
 
-func NewSession(org string, apiToken string) (*Session, error) {
+// NewSession creates a Session for org, retrying rate limited API requests
+// according to retry
+func NewSession(org string, apiToken string, retry RetryPolicy) (*Session, error) {
 	config, err := buildkite.NewTokenConfig(apiToken, false)
 	if err != nil {
 		return nil, err
 	}
+	config.Transport = &retryTransport{
+		policy:    retry,
+		transport: http.DefaultTransport,
+	}
 	return &Session{
 		Org:    org,
 		client: buildkite.NewClient(config.Client()),
@@ -31,8 +46,10 @@ func NewSession(org string, apiToken string) (*Session, error) {
 
 type VmkiteJob struct {
 	ID          string
+	Org         string
 	BuildNumber string
 	Pipeline    string
+	State       string
 	CreatedAt   time.Time
 	Metadata    VmkiteMetadata
 }
@@ -57,8 +74,24 @@ func (v VmkiteJob) VMName() string {
 
 type VmkiteJobQueryParams struct {
 	Pipelines []string
+
+	// Orgs lists jobs across several organizations rather than the
+	// session's Org
+	Orgs []string
+
+	// AgentQueryRules are rules like queue=macos that a job must target, in
+	// addition to the vmkite markers, to be listed
+	AgentQueryRules []string
+
+	// Complete fails with ErrListTruncated rather than returning a partial
+	// list when there are more than MaxPages pages of builds
+	Complete bool
 }
 
+// ErrListTruncated is returned by ListJobs for a Complete query when builds
+// are cut off at MaxPages
+var ErrListTruncated = errors.New("build listing truncated at max pages")
+
 func (bk *Session) PollJobs(query VmkiteJobQueryParams) chan VmkiteJob {
 	ch := make(chan VmkiteJob)
 	listed := make(chan []VmkiteJob)
@@ -68,7 +101,7 @@ func (bk *Session) PollJobs(query VmkiteJobQueryParams) chan VmkiteJob {
 		for {
 			jobs, err := bk.ListJobs(query)
 			if err != nil {
-				debugf("ERROR ListJobs: %v", err)
+				warnf("ListJobs failed: %v", err)
 				continue
 			}
 			listed <- jobs
@@ -98,38 +131,121 @@ func (bk *Session) PollJobs(query VmkiteJobQueryParams) chan VmkiteJob {
 }
 
 func (bk *Session) ListJobs(query VmkiteJobQueryParams) ([]VmkiteJob, error) {
+	orgs := query.Orgs
+	if len(orgs) == 0 {
+		orgs = []string{bk.Org}
+	}
+	jobs := make([]VmkiteJob, 0)
+	for _, org := range orgs {
+		orgJobs, err := bk.listOrgJobs(org, query)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, orgJobs...)
+	}
+	return jobs, nil
+}
+
+func (bk *Session) listOrgJobs(org string, query VmkiteJobQueryParams) ([]VmkiteJob, error) {
 	if len(query.Pipelines) > 0 {
 		jobs := make([]VmkiteJob, 0)
 		for _, pipeline := range query.Pipelines {
-			builds, _, err := bk.client.Builds.ListByPipeline(bk.Org, pipeline, &buildkite.BuildsListOptions{
-				State: []string{"scheduled", "running"},
+			builds, err := bk.listBuilds(query.Complete, func(opt *buildkite.BuildsListOptions) ([]buildkite.Build, *buildkite.Response, error) {
+				return bk.client.Builds.ListByPipeline(org, pipeline, opt)
 			})
 			if err != nil {
 				return nil, err
 			}
-			jobs = append(jobs, readJobsFromBuilds(builds)...)
+			jobs = append(jobs, readJobsFromBuilds(org, builds, query.AgentQueryRules)...)
 		}
 		return jobs, nil
 	}
 
-	builds, _, err := bk.client.Builds.ListByOrg(bk.Org, &buildkite.BuildsListOptions{
-		State: []string{"scheduled", "running"},
+	builds, err := bk.listBuilds(query.Complete, func(opt *buildkite.BuildsListOptions) ([]buildkite.Build, *buildkite.Response, error) {
+		return bk.client.Builds.ListByOrg(org, opt)
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	return readJobsFromBuilds(builds), nil
+	return readJobsFromBuilds(org, builds, query.AgentQueryRules), nil
+}
+
+// ListJobsForOrgs lists vmkite jobs across several organizations, each job's
+// Org is set to the organization it came from
+func (bk *Session) ListJobsForOrgs(orgs []string) ([]VmkiteJob, error) {
+	if len(orgs) == 0 {
+		return []VmkiteJob{}, nil
+	}
+	return bk.ListJobs(VmkiteJobQueryParams{Orgs: orgs})
+}
+
+// ListJobsForPipelines lists vmkite jobs in the given pipelines only, listing
+// builds per pipeline rather than across the whole org
+func (bk *Session) ListJobsForPipelines(pipelines []string) ([]VmkiteJob, error) {
+	if len(pipelines) == 0 {
+		return []VmkiteJob{}, nil
+	}
+	seen := make(map[string]struct{}, len(pipelines))
+	unique := make([]string, 0, len(pipelines))
+	for _, pipeline := range pipelines {
+		if _, ok := seen[pipeline]; !ok {
+			seen[pipeline] = struct{}{}
+			unique = append(unique, pipeline)
+		}
+	}
+	return bk.ListJobs(VmkiteJobQueryParams{Pipelines: unique})
+}
+
+// listBuilds calls list for each page of scheduled and running builds, up to
+// MaxPages pages, failing with ErrListTruncated past that if complete is set
+func (bk *Session) listBuilds(complete bool, list func(*buildkite.BuildsListOptions) ([]buildkite.Build, *buildkite.Response, error)) ([]buildkite.Build, error) {
+	maxPages := bk.MaxPages
+	if maxPages <= 0 {
+		maxPages = defaultMaxPages
+	}
+
+	opt := &buildkite.BuildsListOptions{
+		State: []string{"scheduled", "running"},
+	}
+	var builds []buildkite.Build
+	for page := 1; ; page++ {
+		opt.Page = page
+		pageBuilds, resp, err := list(opt)
+		if err != nil {
+			return nil, err
+		}
+		builds = append(builds, pageBuilds...)
+		if resp == nil || resp.NextPage == 0 {
+			return builds, nil
+		}
+		if page >= maxPages {
+			if complete {
+				return nil, ErrListTruncated
+			}
+			warnf("stopping after %d pages of builds", maxPages)
+			return builds, nil
+		}
+	}
 }
 
-func readJobsFromBuilds(builds []buildkite.Build) []VmkiteJob {
+func readJobsFromBuilds(org string, builds []buildkite.Build, requiredRules []string) []VmkiteJob {
 	jobs := make([]VmkiteJob, 0)
 	for _, build := range builds {
 		for _, job := range build.Jobs {
-			metadata := parseAgentQueryRules(job.AgentQueryRules)
+			if !hasAgentQueryRules(job.AgentQueryRules, requiredRules) {
+				continue
+			}
+			metadata, err := parseAgentQueryRules(job.AgentQueryRules)
+			if err != nil {
+				warnf("skipping job %s: %v", *job.ID, err)
+				continue
+			}
 			if metadata.GuestID != "" && metadata.VMDK != "" {
 				jobs = append(jobs, VmkiteJob{
 					ID:          *job.ID,
+					Org:         org,
+					State:       stringValue(job.State),
 					BuildNumber: strconv.Itoa(*build.Number),
 					Pipeline:    *build.Pipeline.Slug,
 					Metadata:    metadata,
@@ -141,30 +257,73 @@ func readJobsFromBuilds(builds []buildkite.Build) []VmkiteJob {
 	return jobs
 }
 
+// IsFinished returns whether the job is no longer scheduled or running
 func (bk *Session) IsFinished(job VmkiteJob) (bool, error) {
-	debugf("Builds.Get(%s, %s, %s)", bk.Org, job.Pipeline, job.BuildNumber)
-	build, _, err := bk.client.Builds.Get(bk.Org, job.Pipeline, job.BuildNumber)
-	if err != nil {
+	state, err := bk.JobState(job)
+	if err == ErrJobNotFound {
+		return false, nil
+	} else if err != nil {
 		return false, err
 	}
+	switch state {
+	case "scheduled", "running":
+		return false, nil
+	}
+	return true, nil
+}
+
+// ErrJobNotFound is returned by JobState when the job is missing from its build
+var ErrJobNotFound = errors.New("job not found in build")
+
+// JobState returns the current state of the job, e.g. running, passed,
+// failed or canceled
+func (bk *Session) JobState(job VmkiteJob) (string, error) {
+	org := job.Org
+	if org == "" {
+		org = bk.Org
+	}
+	debugf("Builds.Get(%s, %s, %s)", org, job.Pipeline, job.BuildNumber)
+	build, _, err := bk.client.Builds.Get(org, job.Pipeline, job.BuildNumber)
+	if err != nil {
+		return "", err
+	}
 	for _, buildJob := range build.Jobs {
 		if *buildJob.ID == job.ID {
-			switch *buildJob.State {
-			case "scheduled", "running":
-				return false, nil
+			if buildJob.State == nil {
+				return "", nil
 			}
-			return true, nil
+			return *buildJob.State, nil
 		}
 	}
-	return false, nil
+	return "", ErrJobNotFound
 }
 
 type VmkiteMetadata struct {
-	VMDK    string
-	GuestID string
+	VMDK      string
+	GuestID   string
+	MemoryMB  int64
+	NumCPUs   int32
+	Datastore string
+}
+
+// hasAgentQueryRules returns whether rules contains each of required
+func hasAgentQueryRules(rules []string, required []string) bool {
+	for _, r := range required {
+		found := false
+		for _, rule := range rules {
+			if rule == r {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
 }
 
-func parseAgentQueryRules(rules []string) VmkiteMetadata {
+func parseAgentQueryRules(rules []string) (VmkiteMetadata, error) {
 	metadata := VmkiteMetadata{}
 	for _, r := range rules {
 		parts := strings.SplitN(r, "=", 2)
@@ -174,12 +333,60 @@ func parseAgentQueryRules(rules []string) VmkiteMetadata {
 				metadata.VMDK = parts[1]
 			case "vmkite-guestid":
 				metadata.GuestID = parts[1]
+			case "vmkite-memory":
+				memoryMB, err := strconv.ParseInt(parts[1], 10, 64)
+				if err != nil || memoryMB <= 0 {
+					return metadata, fmt.Errorf("invalid vmkite-memory %q, expected a number of MB", parts[1])
+				}
+				metadata.MemoryMB = memoryMB
+			case "vmkite-cpus":
+				numCPUs, err := strconv.ParseInt(parts[1], 10, 32)
+				if err != nil || numCPUs <= 0 {
+					return metadata, fmt.Errorf("invalid vmkite-cpus %q, expected a number of CPUs", parts[1])
+				}
+				metadata.NumCPUs = int32(numCPUs)
+			case "vmkite-datastore":
+				metadata.Datastore = parts[1]
 			}
 		}
 	}
-	return metadata
+	return metadata, nil
+}
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// logf is where debugf output goes, log.Printf unless set with SetLogger
+var logf = log.Printf
+
+// SetLogger routes the package's log output to logger, which is passed
+// messages prefixed with [buildkite]. A nil logger restores log.Printf.
+func SetLogger(logger func(format string, args ...interface{})) {
+	if logger == nil {
+		logger = log.Printf
+	}
+	logf = logger
+}
+
+// debug enables routine trace output, see SetDebug
+var debug = true
+
+// SetDebug turns the package's routine trace output on or off, warnings are
+// logged either way
+func SetDebug(enabled bool) {
+	debug = enabled
 }
 
 func debugf(format string, data ...interface{}) {
-	log.Printf("[buildkite] "+format, data...)
+	if debug {
+		logf("[buildkite] "+format, data...)
+	}
+}
+
+func warnf(format string, data ...interface{}) {
+	logf("[buildkite] WARNING "+format, data...)
 }
@@ -0,0 +1,80 @@
+package buildkite
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy controls how rate limited Buildkite API requests are retried
+type RetryPolicy struct {
+	// MaxRetries is how many times a rate limited request is retried, zero
+	// disables retrying
+	MaxRetries int
+
+	// MinBackoff is the wait before the first retry when the response has no
+	// Retry-After header, doubling on each retry
+	MinBackoff time.Duration
+
+	// MaxBackoff caps the wait between retries
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy retries rate limited requests up to 5 times
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries: 5,
+	MinBackoff: time.Second,
+	MaxBackoff: time.Minute,
+}
+
+// retryTransport retries requests that were rate limited with a 429
+type retryTransport struct {
+	policy    RetryPolicy
+	transport http.RoundTripper
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	backoff := t.policy.MinBackoff
+	for attempt := 0; ; attempt++ {
+		resp, err := t.transport.RoundTrip(req)
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests || attempt >= t.policy.MaxRetries {
+			return resp, err
+		}
+
+		wait := retryAfter(resp, backoff)
+		if t.policy.MaxBackoff > 0 && wait > t.policy.MaxBackoff {
+			wait = t.policy.MaxBackoff
+		}
+		resp.Body.Close()
+		warnf("rate limited on %s, retrying in %v (%d/%d)",
+			req.URL.Path, wait, attempt+1, t.policy.MaxRetries)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+		backoff *= 2
+	}
+}
+
+// retryAfter returns the wait requested by the response's Retry-After
+// header, or fallback if it has none
+func retryAfter(resp *http.Response, fallback time.Duration) time.Duration {
+	header := resp.Header.Get("Retry-After")
+	if header == "" {
+		return fallback
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil {
+		if wait := time.Until(t); wait > 0 {
+			return wait
+		}
+		return 0
+	}
+	return fallback
+}
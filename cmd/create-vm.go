@@ -13,18 +13,35 @@ import (
 
 var (
 	vmClusterPath       string
+	vmHostPath          string
+	vmResourcePoolPath  string
 	vmDS                string
 	vmdkDS              string
 	vmdkPath            string
 	vmNetwork           string
+	vmExtraNetworks     []string
+	vmTags              []string
 	vmMemoryMB          int64
 	vmNumCPUs           int32
 	vmNumCoresPerSocket int32
+	vmAdjustCores       bool
+	vmDiskSizeGB        int64
+	vmDiskMode          string
+	vmControllerType    string
 	vmGuestId           string
+	vmHardwareVersion   string
+	vmFirmware          string
+	vmMACAddress        string
+	vmISOPath           string
+	vmEthernetCardType  string
+	vmDryRun            bool
+	vmCopyDisk          bool
+	vmStoragePolicy     string
 )
 
 var (
-	vmGuestInfo = map[string]string{}
+	vmGuestInfo        = map[string]string{}
+	vmCustomAttributes = map[string]string{}
 )
 
 func ConfigureCreateVM(app *kingpin.Application) {
@@ -40,6 +57,12 @@ func ConfigureCreateVM(app *kingpin.Application) {
 		Required().
 		StringVar(&buildkiteAgentToken)
 
+	cmd.Flag("vm-mac-address", "static MAC address in the 00:50:56:00:00:00-00:50:56:3f:ff:ff range").
+		StringVar(&vmMACAddress)
+
+	cmd.Flag("dry-run", "validate the vm parameters without creating anything").
+		BoolVar(&vmDryRun)
+
 	cmd.Action(cmdCreateVM)
 }
 
@@ -56,10 +79,23 @@ func addCreateVMFlags(cmd *kingpin.CmdClause) {
 		Required().
 		StringVar(&vmClusterPath)
 
+	cmd.Flag("vm-host-path", "path to a host in the cluster to pin the VM to, defaults to DRS placement").
+		StringVar(&vmHostPath)
+
+	cmd.Flag("vm-resource-pool-path", "path to a resource pool in the cluster, defaults to the cluster's root pool").
+		StringVar(&vmResourcePoolPath)
+
 	cmd.Flag("vm-network-label", "name of network to connect VM to").
 		Required().
 		StringVar(&vmNetwork)
 
+	cmd.Flag("vm-extra-network-label", "name of an additional network to connect VM to, may be repeated").
+		StringsVar(&vmExtraNetworks)
+
+	cmd.Flag("vm-ethernet-card-type", "Type of ethernet card, e.g. vmxnet3 or e1000e").
+		Default("vmxnet3").
+		StringVar(&vmEthernetCardType)
+
 	cmd.Flag("vm-memory-mb", "Specify the memory size in MB of the new virtual machine").
 		Required().
 		Int64Var(&vmMemoryMB)
@@ -72,10 +108,45 @@ func addCreateVMFlags(cmd *kingpin.CmdClause) {
 		Required().
 		Int32Var(&vmNumCoresPerSocket)
 
+	cmd.Flag("vm-adjust-cores-per-socket", "Lower the cores per socket to a divisor of the number of cpus instead of failing").
+		BoolVar(&vmAdjustCores)
+
+	cmd.Flag("vm-disk-size-gb", "Size in GB to grow the source disk to, defaults to the source disk size").
+		Int64Var(&vmDiskSizeGB)
+
+	cmd.Flag("vm-disk-mode", "Disk mode of the source disk, e.g. persistent").
+		Default("independent_nonpersistent").
+		StringVar(&vmDiskMode)
+
+	cmd.Flag("vm-disk-controller-type", "Type of controller the disks are attached to").
+		Default("scsi").
+		EnumVar(&vmControllerType, "scsi", "sata", "nvme")
+
+	cmd.Flag("vm-copy-disk", "Copy the source disk to the target datastore and attach it persistently").
+		BoolVar(&vmCopyDisk)
+
+	cmd.Flag("vm-storage-policy", "name of a storage policy to attach to the vm and its disks").
+		StringVar(&vmStoragePolicy)
+
+	cmd.Flag("vm-iso-path", "datastore path of an ISO to attach as a CD-ROM, e.g. \"[datastore1] config.iso\"").
+		StringVar(&vmISOPath)
+
 	cmd.Flag("vm-guest-id", "The guestid of the vm").
 		Default("darwin14_64Guest").
 		StringVar(&vmGuestId)
 
+	cmd.Flag("vm-hardware-version", "The hardware version of the vm, e.g. vmx-13, defaults to vCenter's choice").
+		StringVar(&vmHardwareVersion)
+
+	cmd.Flag("vm-firmware", "The firmware of the vm, bios or efi").
+		EnumVar(&vmFirmware, "bios", "efi")
+
+	cmd.Flag("vm-tag", "A category:tag pair to attach to the vm, can be repeated").
+		StringsVar(&vmTags)
+
+	cmd.Flag("vm-custom-attribute", "A name=value vCenter custom attribute to set on the vm, can be repeated").
+		StringMapVar(&vmCustomAttributes)
+
 	cmd.Flag("vm-guest-info", "A set of key=value params to pass to the vm").
 		StringMapVar(&vmGuestInfo)
 }
@@ -89,20 +160,40 @@ func cmdCreateVM(c *kingpin.ParseContext) error {
 	}
 
 	params := vsphere.VirtualMachineCreationParams{
-		BuildkiteAgentToken: buildkiteAgentToken,
-		ClusterPath:         vmClusterPath,
-		DatastoreName:       vmDS,
-		MemoryMB:            vmMemoryMB,
-		Name:                fmt.Sprintf("vmkite-%s", time.Now().Format("200612-150405")),
-		NetworkLabel:        vmNetwork,
-		NumCPUs:             vmNumCPUs,
-		NumCoresPerSocket:   vmNumCoresPerSocket,
-		SrcDiskDataStore:    vmdkDS,
-		SrcDiskPath:         vmdkPath,
-		GuestInfo:           vmGuestInfo,
+		BuildkiteAgentToken:  buildkiteAgentToken,
+		ClusterPath:          vmClusterPath,
+		HostPath:             vmHostPath,
+		ResourcePoolPath:     vmResourcePoolPath,
+		DatastoreName:        vmDS,
+		MemoryMB:             vmMemoryMB,
+		Name:                 fmt.Sprintf("vmkite-%s", time.Now().Format("200612-150405")),
+		NetworkLabel:         vmNetwork,
+		NetworkLabels:        vmExtraNetworks,
+		EthernetCardType:     vmEthernetCardType,
+		MACAddress:           vmMACAddress,
+		NumCPUs:              vmNumCPUs,
+		NumCoresPerSocket:    vmNumCoresPerSocket,
+		AdjustCoresPerSocket: vmAdjustCores,
+		SrcDiskDataStore:     vmdkDS,
+		SrcDiskPath:          vmdkPath,
+		ISODatastorePath:     vmISOPath,
+		DiskSizeGB:           vmDiskSizeGB,
+		DiskMode:             vmDiskMode,
+		ControllerType:       vmControllerType,
+		CopyDisk:             vmCopyDisk,
+		StoragePolicyName:    vmStoragePolicy,
+		HardwareVersion:      vmHardwareVersion,
+		Firmware:             vmFirmware,
+		GuestInfo:            vmGuestInfo,
+		Tags:                 vmTags,
+		CustomAttributes:     vmCustomAttributes,
+	}
+
+	if vmDryRun {
+		return vs.ValidateCreateVM(ctx, params)
 	}
 
-	_, err = creator.CreateVM(vs, params)
+	_, err = creator.CreateVM(ctx, vs, params)
 	if err != nil {
 		return err
 	}
@@ -31,11 +31,11 @@ func cmdDestroyVM(c *kingpin.ParseContext) error {
 	}
 
 	for _, vmName := range vmNames {
-		vm, err := vs.VirtualMachine(vmPath + "/" + vmName)
+		vm, err := vs.VirtualMachine(ctx, vmPath+"/"+vmName)
 		if err != nil {
 			return err
 		}
-		if err = vm.Destroy(true); err != nil {
+		if err = vm.Destroy(ctx); err != nil {
 			return err
 		}
 	}
@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"github.com/macstadium/vmkite/buildkite"
 	"github.com/macstadium/vmkite/vsphere"
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
 )
@@ -8,6 +9,7 @@ import (
 var (
 	clusterPath      string
 	vmPath           string
+	debug            bool
 	connectionParams vsphere.ConnectionParams
 )
 
@@ -28,6 +30,61 @@ func ConfigureGlobal(app *kingpin.Application) {
 		Default("false").
 		BoolVar(&connectionParams.Insecure)
 
+	app.Flag("vsphere-require-allow-insecure", "refuse --vsphere-insecure unless insecure connections are explicitly allowed").
+		Default("false").
+		BoolVar(&connectionParams.RequireAllowInsecure)
+
+	app.Flag("vsphere-allow-insecure", "allow --vsphere-insecure when --vsphere-require-allow-insecure is set").
+		Envar("VMKITE_ALLOW_INSECURE").
+		Default("false").
+		BoolVar(&connectionParams.AllowInsecure)
+
+	app.Flag("vsphere-ca-cert", "path to CA certificates to verify vSphere against, instead of the system roots").
+		StringVar(&connectionParams.CACertPath)
+
+	app.Flag("vsphere-dial-timeout", "timeout for connecting to vSphere").
+		Default("30s").
+		DurationVar(&connectionParams.DialTimeout)
+
+	app.Flag("vsphere-tls-handshake-timeout", "timeout for the TLS handshake with vSphere").
+		Default("30s").
+		DurationVar(&connectionParams.TLSHandshakeTimeout)
+
+	app.Flag("vsphere-max-retries", "how many times a vSphere task failing with a transient fault is retried").
+		Default("3").
+		IntVar(&connectionParams.Retry.MaxRetries)
+
+	app.Flag("vsphere-retry-backoff", "wait before the first retry of a vSphere task, doubling on each retry").
+		Default("2s").
+		DurationVar(&connectionParams.Retry.MinBackoff)
+
+	app.Flag("vsphere-cache-ttl", "how long vSphere datastore, network, cluster and resource pool lookups are cached").
+		Default("5m").
+		DurationVar(&connectionParams.CacheTTL)
+
+	app.Flag("vsphere-keepalive", "interval between vSphere session keep-alive requests").
+		Default("30s").
+		DurationVar(&connectionParams.KeepAliveInterval)
+
+	app.Flag("vsphere-auto-reconnect", "log in again and retry when the vSphere session has expired").
+		Default("false").
+		BoolVar(&connectionParams.AutoReconnect)
+
+	app.Flag("vsphere-api-version", "vSphere API version, negotiated with the server by default").
+		StringVar(&connectionParams.APIVersion)
+
+	app.Flag("vsphere-datacenter", "name or path of the vSphere datacenter, defaults to the only datacenter").
+		StringVar(&connectionParams.Datacenter)
+
+	app.Flag("debug", "log routine vSphere and Buildkite api traces, --no-debug logs only warnings").
+		Default("true").
+		Action(func(*kingpin.ParseContext) error {
+			vsphere.SetDebug(debug)
+			buildkite.SetDebug(debug)
+			return nil
+		}).
+		BoolVar(&debug)
+
 	app.Flag("vm-path", "path to folder containing virtual machines").
 		Required().
 		StringVar(&vmPath)
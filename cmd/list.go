@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/macstadium/vmkite/vsphere"
+
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+)
+
+func ConfigureList(app *kingpin.Application) {
+	cmd := app.Command("list", "list the clusters, hosts, datastores and networks in the datacenter")
+
+	cmd.Action(cmdList)
+}
+
+func cmdList(c *kingpin.ParseContext) error {
+	ctx := context.Background()
+
+	vs, err := vsphere.NewSession(ctx, connectionParams)
+	if err != nil {
+		return err
+	}
+
+	inv, err := vs.InventorySummary(ctx)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("datacenter: %s\n", inv.Datacenter)
+	printList("clusters (--vm-cluster-path)", inv.Clusters)
+	printList("hosts (--vm-host-path)", inv.Hosts)
+	printList("datastores (--target-datastore, --source-datastore)", inv.Datastores)
+	printList("networks (--vm-network-label)", inv.Networks)
+
+	return nil
+}
+
+func printList(heading string, items []string) {
+	fmt.Printf("\n%s:\n", heading)
+	for _, item := range items {
+		fmt.Printf("  %s\n", item)
+	}
+}
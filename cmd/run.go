@@ -12,8 +12,11 @@ import (
 var (
 	buildkiteApiToken   string
 	buildkiteAgentToken string
-	buildkiteOrg        string
+	buildkiteOrgs       []string
 	buildkitePipelines  []string
+	buildkiteQueryRules []string
+	buildkiteMaxPages   int
+	buildkiteMaxRetries int
 	concurrency         int
 	apiListenOn         string
 	apiTokenSecret      string
@@ -30,13 +33,24 @@ func ConfigureRun(app *kingpin.Application) {
 		Required().
 		StringVar(&buildkiteApiToken)
 
-	cmd.Flag("buildkite-org", "Buildkite organization slug").
+	cmd.Flag("buildkite-org", "Buildkite organization slug, can be repeated").
 		Required().
-		StringVar(&buildkiteOrg)
+		StringsVar(&buildkiteOrgs)
 
 	cmd.Flag("buildkite-pipeline", "Limit to a specific buildkite pipelines").
 		StringsVar(&buildkitePipelines)
 
+	cmd.Flag("buildkite-agent-query-rule", "Only run jobs targeting this agent query rule, e.g. queue=macos").
+		StringsVar(&buildkiteQueryRules)
+
+	cmd.Flag("buildkite-max-pages", "Limit how many pages of builds are listed per poll").
+		Default("10").
+		IntVar(&buildkiteMaxPages)
+
+	cmd.Flag("buildkite-max-retries", "Limit how many times a rate limited api request is retried").
+		Default("5").
+		IntVar(&buildkiteMaxRetries)
+
 	cmd.Flag("concurrency", "Limit how many concurrent jobs are run").
 		Default("3").
 		IntVar(&concurrency)
@@ -58,30 +72,50 @@ func cmdRun(c *kingpin.ParseContext) error {
 		return err
 	}
 
-	bk, err := buildkite.NewSession(buildkiteOrg, buildkiteApiToken)
+	retry := buildkite.DefaultRetryPolicy
+	retry.MaxRetries = buildkiteMaxRetries
+	bk, err := buildkite.NewSession(buildkiteOrgs[0], buildkiteApiToken, retry)
 	if err != nil {
 		return err
 	}
+	bk.MaxPages = buildkiteMaxPages
 
 	r := runner.NewRunner(vs, bk, runner.Params{
 		Concurrency:    concurrency,
 		Pipelines:      buildkitePipelines,
+		Orgs:           buildkiteOrgs,
+		QueryRules:     buildkiteQueryRules,
 		ApiListenOn:    apiListenOn,
 		ApiTokenSecret: apiTokenSecret,
 	})
 
 	return r.Run(vsphere.VirtualMachineCreationParams{
-		BuildkiteAgentToken: buildkiteAgentToken,
-		ClusterPath:         vmClusterPath,
-		VirtualMachinePath:  vmPath,
-		DatastoreName:       vmDS,
-		MemoryMB:            vmMemoryMB,
-		Name:                "", // automatic
-		NetworkLabel:        vmNetwork,
-		NumCPUs:             vmNumCPUs,
-		NumCoresPerSocket:   vmNumCoresPerSocket,
-		SrcDiskDataStore:    vmdkDS,
-		SrcDiskPath:         "", // per-job
-		GuestInfo:           vmGuestInfo,
+		BuildkiteAgentToken:  buildkiteAgentToken,
+		ClusterPath:          vmClusterPath,
+		HostPath:             vmHostPath,
+		ResourcePoolPath:     vmResourcePoolPath,
+		VirtualMachinePath:   vmPath,
+		DatastoreName:        vmDS,
+		MemoryMB:             vmMemoryMB,
+		Name:                 "", // automatic
+		NetworkLabel:         vmNetwork,
+		NetworkLabels:        vmExtraNetworks,
+		EthernetCardType:     vmEthernetCardType,
+		NumCPUs:              vmNumCPUs,
+		NumCoresPerSocket:    vmNumCoresPerSocket,
+		AdjustCoresPerSocket: vmAdjustCores,
+		SrcDiskDataStore:     vmdkDS,
+		SrcDiskPath:          "", // per-job
+		ISODatastorePath:     vmISOPath,
+		DiskSizeGB:           vmDiskSizeGB,
+		DiskMode:             vmDiskMode,
+		ControllerType:       vmControllerType,
+		CopyDisk:             vmCopyDisk,
+		StoragePolicyName:    vmStoragePolicy,
+		HardwareVersion:      vmHardwareVersion,
+		Firmware:             vmFirmware,
+		GuestInfo:            vmGuestInfo,
+		Tags:                 vmTags,
+		CustomAttributes:     vmCustomAttributes,
 	})
 }
@@ -1,15 +1,17 @@
 package creator
 
 import (
+	"context"
+
 	"github.com/macstadium/vmkite/vsphere"
 )
 
-func CreateVM(vs *vsphere.Session, params vsphere.VirtualMachineCreationParams) (*vsphere.VirtualMachine, error) {
-	vm, err := vs.CreateVM(params)
+func CreateVM(ctx context.Context, vs *vsphere.Session, params vsphere.VirtualMachineCreationParams) (*vsphere.VirtualMachine, error) {
+	vm, err := vs.CreateVM(ctx, params)
 	if err != nil {
 		return nil, err
 	}
-	if err := vm.PowerOn(); err != nil {
+	if err := vm.PowerOn(ctx); err != nil {
 		return nil, err
 	}
 	return vm, nil
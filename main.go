@@ -31,6 +31,7 @@ func run(args []string, exit func(code int)) {
 
 	cmd.ConfigureCreateVM(app)
 	cmd.ConfigureDestroyVM(app)
+	cmd.ConfigureList(app)
 	cmd.ConfigureRun(app)
 
 	kingpin.MustParse(app.Parse(args))
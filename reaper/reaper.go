@@ -0,0 +1,79 @@
+// Package reaper cleans up vmkite VMs whose Buildkite jobs have finished
+package reaper
+
+import (
+	"context"
+	"log"
+
+	"github.com/macstadium/vmkite/buildkite"
+	"github.com/macstadium/vmkite/vsphere"
+)
+
+// Params controls which VMs ReapFinished destroys
+type Params struct {
+	// Orgs are where jobs are looked up, defaulting to the session's Org
+	Orgs []string
+
+	// ReapOrphans also destroys VMs without a scheduled or running job in
+	// Orgs, for when every vmkite VM is known to belong to a job there
+	ReapOrphans bool
+}
+
+// ReapFinished destroys the vmkite VMs whose Buildkite job has finished,
+// returning the names of the destroyed VMs. VMs are matched to jobs by their
+// guestinfo.vmkite-job-id, falling back to guestinfo.vmkite-name. VMs without
+// a scheduled or running job are left alone unless params.ReapOrphans is set.
+// It refuses to run if the job listing is cut off at the session's MaxPages.
+func ReapFinished(ctx context.Context, bk *buildkite.Session, vs *vsphere.Session, params Params) ([]string, error) {
+	// list VMs before jobs, so a VM created in between for a new job can't
+	// be mistaken for one without a job
+	vms, err := vs.ListVmkiteVMs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	jobs, err := bk.ListJobs(buildkite.VmkiteJobQueryParams{Orgs: params.Orgs, Complete: true})
+	if err != nil {
+		return nil, err
+	}
+	jobsByID := make(map[string]buildkite.VmkiteJob, len(jobs))
+	jobsByVMName := make(map[string]buildkite.VmkiteJob, len(jobs))
+	for _, job := range jobs {
+		jobsByID[job.ID] = job
+		jobsByVMName[job.VMName()] = job
+	}
+
+	destroyed := []string{}
+	for _, vm := range vms {
+		job, ok := jobsByID[vm.VmkiteJobID]
+		if vm.VmkiteJobID == "" {
+			job, ok = jobsByVMName[vm.VmkiteName]
+		}
+		if ok {
+			finished, err := bk.IsFinished(job)
+			if err != nil {
+				return destroyed, err
+			}
+			if !finished {
+				debugf("vm %s has running job %s", vm.Name, job.String())
+				continue
+			}
+			debugf("vm %s has finished job %s", vm.Name, job.String())
+		} else if params.ReapOrphans {
+			debugf("vm %s has no scheduled or running job", vm.Name)
+		} else {
+			debugf("vm %s has no scheduled or running job, skipping", vm.Name)
+			continue
+		}
+
+		debugf("destroying vm %s", vm.Name)
+		if err := vm.Destroy(ctx); err != nil {
+			return destroyed, err
+		}
+		destroyed = append(destroyed, vm.Name)
+	}
+	return destroyed, nil
+}
+
+func debugf(format string, data ...interface{}) {
+	log.Printf("[reaper] "+format, data...)
+}
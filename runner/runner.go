@@ -15,6 +15,8 @@ import (
 
 type Params struct {
 	Pipelines      []string
+	Orgs           []string
+	QueryRules     []string
 	Concurrency    int
 	ApiListenOn    string
 	ApiTokenSecret string
@@ -43,7 +45,9 @@ func (r *Runner) Run(createParams vsphere.VirtualMachineCreationParams) error {
 	}
 
 	jobs := r.bk.PollJobs(buildkite.VmkiteJobQueryParams{
-		Pipelines: r.params.Pipelines,
+		Pipelines:       r.params.Pipelines,
+		Orgs:            r.params.Orgs,
+		AgentQueryRules: r.params.QueryRules,
 	})
 
 	for i := 0; i < r.params.Concurrency; i++ {
@@ -76,7 +80,9 @@ func (r *Runner) Run(createParams vsphere.VirtualMachineCreationParams) error {
 
 func (r *Runner) runJob(createParams vsphere.VirtualMachineCreationParams, job buildkite.VmkiteJob, events chan apiHookEvent) error {
 	debugf("running job %v", job.ID)
-	vm, err := r.createVMForJob(createParams, job)
+	createCtx, cancelCreate := context.WithTimeout(context.Background(), time.Minute*5)
+	vm, err := r.createVMForJob(createCtx, createParams, job)
+	cancelCreate()
 	if err != nil {
 		return err
 	}
@@ -95,14 +101,14 @@ func (r *Runner) runJob(createParams vsphere.VirtualMachineCreationParams, job b
 				event.Event, event.JobID, event.Timestamp.Sub(job.CreatedAt))
 
 		case <-ticker.C:
-			poweredOn, err := vm.IsPoweredOn()
+			poweredOn, err := vm.IsPoweredOn(ctx)
 			if err != nil {
 				return fmt.Errorf("vm.IsPoweredOn failed: %v", err)
 			}
 
 			if !poweredOn {
 				debugf("VM is powered off, destroying")
-				return vm.Destroy(true)
+				return vm.Destroy(ctx)
 			}
 
 		case <-ctx.Done():
@@ -111,8 +117,8 @@ func (r *Runner) runJob(createParams vsphere.VirtualMachineCreationParams, job b
 	}
 }
 
-func (r *Runner) createVMForJob(createParams vsphere.VirtualMachineCreationParams, job buildkite.VmkiteJob) (*vsphere.VirtualMachine, error) {
-	if existing, err := r.vs.VirtualMachine(job.VMName()); err == nil {
+func (r *Runner) createVMForJob(ctx context.Context, createParams vsphere.VirtualMachineCreationParams, job buildkite.VmkiteJob) (*vsphere.VirtualMachine, error) {
+	if existing, err := r.vs.VirtualMachine(ctx, job.VMName()); err == nil {
 		debugf("vm %s already exists, skipping create", existing.Name)
 		return existing, nil
 	}
@@ -120,10 +126,22 @@ func (r *Runner) createVMForJob(createParams vsphere.VirtualMachineCreationParam
 	// add parameters from the job
 	createParams.SrcDiskPath = job.Metadata.VMDK
 	createParams.GuestID = job.Metadata.GuestID
+	if job.Metadata.MemoryMB > 0 {
+		createParams.MemoryMB = job.Metadata.MemoryMB
+	}
+	if job.Metadata.NumCPUs > 0 {
+		createParams.NumCPUs = job.Metadata.NumCPUs
+	}
+	if job.Metadata.Datastore != "" {
+		createParams.DatastoreName = job.Metadata.Datastore
+	}
 	createParams.Name = job.VMName()
+	createParams.BuildkiteJobID = job.ID
+	createParams.BuildkitePipeline = job.Pipeline
+	createParams.Annotation = fmt.Sprintf("Created by vmkite for Buildkite job %s", job.String())
 
 	debugf("createVM(%s) => %s %s", job.String(), job.Metadata.VMDK, job.Metadata.GuestID)
-	vm, err := creator.CreateVM(r.vs, createParams)
+	vm, err := creator.CreateVM(ctx, r.vs, createParams)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,77 @@
+package vsphere
+
+import (
+	"context"
+	"sort"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// SetCustomAttributes sets vCenter custom attributes on the VM, creating any
+// fields that don't exist yet as VirtualMachine custom fields
+func (vm *VirtualMachine) SetCustomAttributes(ctx context.Context, attrs map[string]string) error {
+	if len(attrs) == 0 {
+		return nil
+	}
+	m, err := object.GetCustomFieldsManager(vm.vs.client.Client)
+	if err != nil {
+		return err
+	}
+	debugf("customFieldsManager.Field()")
+	fields, err := m.Field(ctx)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		key, err := ensureCustomField(ctx, m, fields, name)
+		if err != nil {
+			return err
+		}
+		debugf("customFieldsManager.Set(%s, %s=%s)", vm.Name, name, attrs[name])
+		if err := m.Set(ctx, vm.mo.Reference(), key, attrs[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureCustomField returns the key of the VM or global custom field named
+// name, adding a VirtualMachine field if there isn't one
+func ensureCustomField(ctx context.Context, m *object.CustomFieldsManager, fields []types.CustomFieldDef, name string) (int32, error) {
+	if key, ok := findCustomField(fields, name); ok {
+		return key, nil
+	}
+	debugf("customFieldsManager.Add(%s)", name)
+	def, err := m.Add(ctx, name, "VirtualMachine", nil, nil)
+	if isDuplicateName(err) {
+		debugf("custom field %s was created concurrently", name)
+		fields, err := m.Field(ctx)
+		if err != nil {
+			return -1, err
+		}
+		if key, ok := findCustomField(fields, name); ok {
+			return key, nil
+		}
+		return -1, object.ErrKeyNameNotFound
+	} else if err != nil {
+		return -1, err
+	}
+	return def.Key, nil
+}
+
+func findCustomField(fields []types.CustomFieldDef, name string) (int32, bool) {
+	for _, def := range fields {
+		if def.Name == name && (def.ManagedObjectType == "" || def.ManagedObjectType == "VirtualMachine") {
+			return def.Key, true
+		}
+	}
+	return -1, false
+}
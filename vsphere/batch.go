@@ -0,0 +1,52 @@
+package vsphere
+
+import (
+	"context"
+	"sync"
+)
+
+// CreateVMs creates a VM for each of params, running up to concurrency
+// creations at once. The results are in the same order as params, a failed
+// creation has a nil VM and its error, and doesn't stop the others.
+func (vs *Session) CreateVMs(ctx context.Context, params []VirtualMachineCreationParams, concurrency int) ([]*VirtualMachine, []error) {
+	vms := make([]*VirtualMachine, len(params))
+	errs := make([]error, len(params))
+	if len(params) == 0 {
+		return vms, errs
+	}
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	// resolve the datacenter once, rather than racing in each worker
+	if _, err := vs.getFinder(ctx); err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return vms, errs
+	}
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency && w < len(params); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if err := ctx.Err(); err != nil {
+					errs[i] = err
+					continue
+				}
+				debugf("batch creating vm %d/%d: %s", i+1, len(params), params[i].Name)
+				vms[i], errs[i] = vs.CreateVM(ctx, params[i])
+			}
+		}()
+	}
+	for i := range params {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	return vms, errs
+}
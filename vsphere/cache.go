@@ -0,0 +1,153 @@
+package vsphere
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/task"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// lookupCache holds inventory objects found by name, so repeated CreateVM
+// calls don't repeat the same finder lookups
+type lookupCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+func (c *lookupCache) get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry.value, true
+}
+
+func (c *lookupCache) set(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]cacheEntry)
+	}
+	entry := cacheEntry{value: value}
+	if c.ttl > 0 {
+		entry.expires = time.Now().Add(c.ttl)
+	}
+	c.entries[key] = entry
+}
+
+func (c *lookupCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = nil
+}
+
+// SetCacheTTL sets how long datastore, network, cluster and resource pool
+// lookups are cached, zero caches them until ClearCache is called
+func (vs *Session) SetCacheTTL(ttl time.Duration) {
+	vs.cache.mu.Lock()
+	defer vs.cache.mu.Unlock()
+	vs.cache.ttl = ttl
+}
+
+// ClearCache forgets cached inventory lookups, e.g. after the inventory has
+// changed
+func (vs *Session) ClearCache() {
+	debugf("clearing lookup cache")
+	vs.cache.clear()
+}
+
+// isManagedObjectNotFound reports whether err is vCenter rejecting a
+// reference to an object that no longer exists, e.g. a cached datastore that
+// was removed and recreated
+func isManagedObjectNotFound(err error) bool {
+	if taskErr, ok := err.(task.Error); ok {
+		_, ok := taskErr.Fault().(*types.ManagedObjectNotFound)
+		return ok
+	}
+	if soap.IsSoapFault(err) {
+		switch soap.ToSoapFault(err).VimFault().(type) {
+		case types.ManagedObjectNotFound:
+			return true
+		}
+	}
+	return false
+}
+
+// cachedLookup returns the cached value for kind and name, calling lookup
+// and caching its result on a miss
+func (vs *Session) cachedLookup(kind, name string, lookup func() (interface{}, error)) (interface{}, error) {
+	key := kind + ":" + name
+	if value, ok := vs.cache.get(key); ok {
+		debugf("cache hit for %s", key)
+		return value, nil
+	}
+	value, err := lookup()
+	if err != nil {
+		return nil, err
+	}
+	vs.cache.set(key, value)
+	return value, nil
+}
+
+func (vs *Session) findDatastore(ctx context.Context, finder *find.Finder, name string) (*object.Datastore, error) {
+	value, err := vs.cachedLookup("datastore", name, func() (interface{}, error) {
+		debugf("finder.Datastore(%s)", name)
+		v, err := finder.Datastore(ctx, name)
+		return v, wrapNotFound(err, ErrDatastoreNotFound, name)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(*object.Datastore), nil
+}
+
+func (vs *Session) findCluster(ctx context.Context, finder *find.Finder, clusterPath string) (*object.ClusterComputeResource, error) {
+	value, err := vs.cachedLookup("cluster", clusterPath, func() (interface{}, error) {
+		debugf("finder.ClusterComputeResource(%s)", clusterPath)
+		v, err := finder.ClusterComputeResource(ctx, clusterPath)
+		return v, wrapNotFound(err, ErrClusterNotFound, clusterPath)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(*object.ClusterComputeResource), nil
+}
+
+func (vs *Session) findResourcePool(ctx context.Context, finder *find.Finder, poolPath string) (*object.ResourcePool, error) {
+	value, err := vs.cachedLookup("resourcepool", poolPath, func() (interface{}, error) {
+		debugf("finder.ResourcePool(%s)", poolPath)
+		v, err := finder.ResourcePool(ctx, poolPath)
+		return v, wrapNotFound(err, ErrResourcePoolNotFound, poolPath)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(*object.ResourcePool), nil
+}
+
+func (vs *Session) findNetwork(ctx context.Context, finder *find.Finder, label string) (object.NetworkReference, error) {
+	value, err := vs.cachedLookup("network", label, func() (interface{}, error) {
+		return findNetwork(ctx, finder, label)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(object.NetworkReference), nil
+}
@@ -0,0 +1,32 @@
+package vsphere
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCacheTTLFromConnectionParams(t *testing.T) {
+	vs := newSession(ConnectionParams{CacheTTL: 10 * time.Millisecond})
+	lookups := 0
+	lookup := func() (interface{}, error) {
+		lookups++
+		return lookups, nil
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := vs.cachedLookup("datastore", "ds1", lookup); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if lookups != 1 {
+		t.Errorf("looked up %d times before the ttl expired, want 1", lookups)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if _, err := vs.cachedLookup("datastore", "ds1", lookup); err != nil {
+		t.Fatal(err)
+	}
+	if lookups != 2 {
+		t.Errorf("looked up %d times after the ttl expired, want 2", lookups)
+	}
+}
@@ -0,0 +1,65 @@
+package vsphere
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// ConsoleURL acquires a WebMKS ticket for the VM and returns the websocket
+// URL an HTML5 console connects to. Tickets are single use and expire
+// quickly, so the URL should be handed out as soon as it's generated.
+func (vm *VirtualMachine) ConsoleURL(ctx context.Context) (string, error) {
+	debugf("vm.AcquireTicket(%s, webmks)", vm.Name)
+	res, err := methods.AcquireTicket(ctx, vm.vs.client.Client, &types.AcquireTicket{
+		This:       vm.mo.Reference(),
+		TicketType: "webmks",
+	})
+	if err != nil {
+		return "", err
+	}
+	ticket := res.Returnval
+	host := ticket.Host
+	if host == "" {
+		host = vm.vs.client.URL().Hostname()
+	}
+	port := ticket.Port
+	if port == 0 {
+		port = 443
+	}
+	u := url.URL{
+		Scheme: "wss",
+		Host:   net.JoinHostPort(host, strconv.Itoa(int(port))),
+		Path:   "/ticket/" + ticket.Ticket,
+	}
+	return u.String(), nil
+}
+
+// VMRCURL returns a vmrc:// URL that opens the VM in VMware Remote Console,
+// authenticated with a clone ticket of the current session
+func (vm *VirtualMachine) VMRCURL(ctx context.Context) (string, error) {
+	client := vm.vs.client.Client
+	if client.ServiceContent.SessionManager == nil {
+		return "", errors.New("server has no session manager")
+	}
+	debugf("sessionManager.AcquireCloneTicket(%s)", vm.Name)
+	res, err := methods.AcquireCloneTicket(ctx, client, &types.AcquireCloneTicket{
+		This: *client.ServiceContent.SessionManager,
+	})
+	if err != nil {
+		return "", err
+	}
+	u := url.URL{
+		Scheme:   "vmrc",
+		User:     url.UserPassword("clone", res.Returnval),
+		Host:     client.URL().Host,
+		Path:     "/",
+		RawQuery: url.Values{"moid": {vm.mo.Reference().Value}}.Encode(),
+	}
+	return u.String(), nil
+}
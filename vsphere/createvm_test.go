@@ -0,0 +1,104 @@
+package vsphere
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+func newReauthSession(f *fakeVC, autoReconnect bool) (*Session, *int) {
+	vs := f.session()
+	logins := 0
+	vs.autoReconnect = autoReconnect
+	vs.login = func(ctx context.Context) error {
+		logins++
+		return nil
+	}
+	return vs, &logins
+}
+
+func testPlacement(f *fakeVC, vs *Session) *vmPlacement {
+	pool := f.add(types.ManagedObjectReference{}, "ResourcePool", "Resources")
+	return &vmPlacement{resourcePool: object.NewResourcePool(vs.client.Client, pool)}
+}
+
+func TestCreateVMReauthOnSubmit(t *testing.T) {
+	f := newFakeVC(t)
+	vs, logins := newReauthSession(f, true)
+	f.fail("CreateVM_Task", notAuthenticatedFault())
+
+	params := VirtualMachineCreationParams{Name: "vmkite-1"}
+	vm, err := vs.createVMInFolder(context.Background(), params, testPlacement(f, vs), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vm.Name != "vmkite-1" {
+		t.Errorf("created vm %s, want vmkite-1", vm.Name)
+	}
+	if *logins != 1 {
+		t.Errorf("logged in %d times, want 1", *logins)
+	}
+	if n := f.count("CreateVM_Task"); n != 2 {
+		t.Errorf("CreateVM_Task called %d times, want 2", n)
+	}
+}
+
+func TestCreateVMReauthWhileWaiting(t *testing.T) {
+	f := newFakeVC(t)
+	vs, logins := newReauthSession(f, true)
+	f.fail("WaitForUpdatesEx", notAuthenticatedFault())
+
+	params := VirtualMachineCreationParams{Name: "vmkite-1"}
+	if _, err := vs.createVMInFolder(context.Background(), params, testPlacement(f, vs), nil); err != nil {
+		t.Fatal(err)
+	}
+	if *logins != 1 {
+		t.Errorf("logged in %d times, want 1", *logins)
+	}
+	// the submitted task is waited on again rather than creating another vm
+	if n := f.count("CreateVM_Task"); n != 1 {
+		t.Errorf("CreateVM_Task called %d times, want 1", n)
+	}
+	if n := len(f.objects[f.vmFolder].children); n != 1 {
+		t.Errorf("created %d vms, want 1", n)
+	}
+}
+
+func TestCreateVMWithoutAutoReconnect(t *testing.T) {
+	f := newFakeVC(t)
+	vs, logins := newReauthSession(f, false)
+	f.fail("CreateVM_Task", notAuthenticatedFault())
+
+	params := VirtualMachineCreationParams{Name: "vmkite-1"}
+	_, err := vs.createVMInFolder(context.Background(), params, testPlacement(f, vs), nil)
+	if !isNotAuthenticated(err) {
+		t.Fatalf("got error %v, want NotAuthenticated", err)
+	}
+	if *logins != 0 {
+		t.Errorf("logged in %d times, want 0", *logins)
+	}
+}
+
+func TestCreateVMNotResubmittedAfterWaitFails(t *testing.T) {
+	f := newFakeVC(t)
+	vs := f.session()
+	vs.retry = RetryPolicy{MaxRetries: 3, MinBackoff: time.Millisecond}
+	fault := &soap.Fault{Code: "ServerFaultCode", String: "vCenter is busy"}
+	fault.Detail.Fault = types.SystemError{}
+	f.fail("WaitForUpdatesEx", soap.WrapSoapFault(fault))
+
+	params := VirtualMachineCreationParams{Name: "vmkite-1", NameCollisionRetries: 3}
+	if _, err := vs.createVMInFolder(context.Background(), params, testPlacement(f, vs), nil); err == nil {
+		t.Fatal("created vm without an error from waiting for the task")
+	}
+	if n := f.count("CreateVM_Task"); n != 1 {
+		t.Errorf("CreateVM_Task called %d times, want 1", n)
+	}
+	if n := len(f.objects[f.vmFolder].children); n != 1 {
+		t.Errorf("created %d vms, want 1", n)
+	}
+}
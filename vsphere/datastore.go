@@ -0,0 +1,138 @@
+package vsphere
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/task"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// SetMinDatastoreFreeSpace sets the free space in bytes a datastore needs for
+// PickDatastore to choose it
+func (vs *Session) SetMinDatastoreFreeSpace(bytes int64) {
+	vs.minDatastoreFree = bytes
+}
+
+// PickDatastore returns the name of the candidate datastore with the most free
+// space
+func (vs *Session) PickDatastore(ctx context.Context, candidates []string) (string, error) {
+	if len(candidates) == 0 {
+		return "", errors.New("no candidate datastores")
+	}
+	finder, err := vs.getFinder(ctx)
+	if err != nil {
+		return "", err
+	}
+	refs := make([]types.ManagedObjectReference, len(candidates))
+	for i, name := range candidates {
+		ds, err := vs.findDatastore(ctx, finder, name)
+		if err != nil {
+			return "", err
+		}
+		refs[i] = ds.Reference()
+	}
+
+	var mdss []mo.Datastore
+	pc := property.DefaultCollector(vs.client.Client)
+	if err := pc.Retrieve(ctx, refs, []string{"summary.name", "summary.freeSpace"}, &mdss); err != nil {
+		return "", err
+	}
+
+	var best *types.DatastoreSummary
+	for i := range mdss {
+		summary := &mdss[i].Summary
+		debugf("datastore %s has %d bytes free", summary.Name, summary.FreeSpace)
+		if best == nil || summary.FreeSpace > best.FreeSpace {
+			best = summary
+		}
+	}
+	if best == nil || best.FreeSpace <= vs.minDatastoreFree {
+		return "", fmt.Errorf("none of the datastores %v have more than %d bytes free",
+			candidates, vs.minDatastoreFree)
+	}
+	debugf("picked datastore %s", best.Name)
+	return best.Name, nil
+}
+
+// DatastoreFileExists returns whether filePath exists on the named datastore,
+// e.g. to check a source disk before creating a VM
+func (vs *Session) DatastoreFileExists(ctx context.Context, datastoreName, filePath string) (bool, error) {
+	files, err := vs.searchDatastore(ctx, datastoreName, path.Dir(filePath), path.Base(filePath))
+	if isFileNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return len(files) > 0, nil
+}
+
+// ListDatastoreFiles returns the names of the files and folders in dir on the
+// named datastore
+func (vs *Session) ListDatastoreFiles(ctx context.Context, datastoreName, dir string) ([]string, error) {
+	files, err := vs.searchDatastore(ctx, datastoreName, dir, "*")
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(files))
+	for i, file := range files {
+		names[i] = file.GetFileInfo().Path
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// searchDatastore lists the files in dir on the named datastore matching
+// pattern, using the datastore's HostDatastoreBrowser
+func (vs *Session) searchDatastore(ctx context.Context, datastoreName, dir, pattern string) ([]types.BaseFileInfo, error) {
+	finder, err := vs.getFinder(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ds, err := vs.findDatastore(ctx, finder, datastoreName)
+	if err != nil {
+		return nil, err
+	}
+	browser, err := ds.Browser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	dsPath := ds.Path(dir)
+	debugf("browser.SearchDatastore(%s, %s)", dsPath, pattern)
+	var info *types.TaskInfo
+	err = vs.withRetry(ctx, "SearchDatastore "+dsPath, func() error {
+		task, err := browser.SearchDatastore(ctx, dsPath, &types.HostDatastoreBrowserSearchSpec{
+			Details:      &types.FileQueryFlags{FileType: true},
+			MatchPattern: []string{pattern},
+		})
+		if err != nil {
+			return err
+		}
+		info, err = task.WaitForResult(ctx, nil)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	results, ok := info.Result.(types.HostDatastoreBrowserSearchResults)
+	if !ok {
+		return nil, fmt.Errorf("unexpected search result %T for %s", info.Result, dsPath)
+	}
+	return results.File, nil
+}
+
+// isFileNotFound returns whether err is a datastore FileNotFound fault, as
+// returned when searching a folder that doesn't exist
+func isFileNotFound(err error) bool {
+	if taskErr, ok := err.(task.Error); ok {
+		_, ok := taskErr.Fault().(*types.FileNotFound)
+		return ok
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package vsphere
+
+import (
+	"context"
+	"fmt"
+	"path"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// copiedDiskFolder is the datastore folder CopyDisk copies source disks into
+const copiedDiskFolder = "vmkite-disks"
+
+// copySourceDisk copies the source disk to the VM's datastore for CopyDisk,
+// returning params updated to attach the copy persistently
+func (vs *Session) copySourceDisk(ctx context.Context, params VirtualMachineCreationParams) (VirtualMachineCreationParams, error) {
+	finder, err := vs.getFinder(ctx)
+	if err != nil {
+		return params, err
+	}
+	src, err := vs.findDatastore(ctx, finder, params.SrcDiskDataStore)
+	if err != nil {
+		return params, err
+	}
+	dst, err := vs.findDatastore(ctx, finder, params.DatastoreName)
+	if err != nil {
+		return params, err
+	}
+
+	dir := dst.Path(copiedDiskFolder)
+	debugf("fileManager.MakeDirectory(%s)", dir)
+	err = object.NewFileManager(vs.client.Client).MakeDirectory(ctx, dir, vs.datacenter, true)
+	if err != nil && !isFileAlreadyExists(err) {
+		return params, err
+	}
+
+	copyPath := path.Join(copiedDiskFolder, params.Name+".vmdk")
+	debugf("virtualDiskManager.CopyVirtualDisk(%s, %s)", src.Path(params.SrcDiskPath), dst.Path(copyPath))
+	err = vs.withRetry(ctx, "CopyVirtualDisk "+params.Name, func() error {
+		task, err := object.NewVirtualDiskManager(vs.client.Client).CopyVirtualDisk(ctx,
+			src.Path(params.SrcDiskPath), vs.datacenter,
+			dst.Path(copyPath), vs.datacenter,
+			nil, false)
+		if err != nil {
+			return err
+		}
+		debugf("waiting for CopyVirtualDisk %v", task)
+		return task.Wait(ctx)
+	})
+	if err != nil {
+		return params, fmt.Errorf("copying disk %s: %s", src.Path(params.SrcDiskPath), err)
+	}
+
+	params.SrcDiskDataStore = params.DatastoreName
+	params.SrcDiskPath = copyPath
+	params.DiskMode = string(types.VirtualDiskModePersistent)
+	return params, nil
+}
+
+// deleteCopiedDisk removes a disk copied by copySourceDisk, for when creating
+// the VM that would own it fails
+func (vs *Session) deleteCopiedDisk(ctx context.Context, params VirtualMachineCreationParams) {
+	name := fmt.Sprintf("[%s] %s", params.SrcDiskDataStore, params.SrcDiskPath)
+	debugf("virtualDiskManager.DeleteVirtualDisk(%s)", name)
+	err := vs.withRetry(ctx, "DeleteVirtualDisk "+name, func() error {
+		task, err := object.NewVirtualDiskManager(vs.client.Client).DeleteVirtualDisk(ctx, name, vs.datacenter)
+		if err != nil {
+			return err
+		}
+		return task.Wait(ctx)
+	})
+	if err != nil {
+		warnf("failed to delete copied disk %s: %s", name, err)
+	}
+}
+
+func isFileAlreadyExists(err error) bool {
+	if soap.IsSoapFault(err) {
+		switch soap.ToSoapFault(err).VimFault().(type) {
+		case types.FileAlreadyExists:
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,28 @@
+package vsphere
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/vmware/govmomi/find"
+)
+
+// Errors returned, wrapped with the name that wasn't found, when inventory
+// lookups fail. Check for them with errors.Is.
+var (
+	ErrVirtualMachineNotFound = errors.New("virtual machine not found")
+	ErrDatastoreNotFound      = errors.New("datastore not found")
+	ErrNetworkNotFound        = errors.New("network not found")
+	ErrClusterNotFound        = errors.New("cluster not found")
+	ErrResourcePoolNotFound   = errors.New("resource pool not found")
+	ErrHostNotFound           = errors.New("host not found")
+)
+
+// wrapNotFound wraps a finder's NotFoundError for name with sentinel, other
+// errors are returned unchanged
+func wrapNotFound(err error, sentinel error, name string) error {
+	if _, ok := err.(*find.NotFoundError); ok {
+		return fmt.Errorf("%w: %s", sentinel, name)
+	}
+	return err
+}
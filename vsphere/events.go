@@ -0,0 +1,72 @@
+package vsphere
+
+import (
+	"context"
+	"errors"
+
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// WatchVMEvents calls handler with each vSphere event for vm, such as it being
+// powered on, migrated or destroyed, from now until ctx is canceled. The
+// vendored govmomi has no event.Manager, so this follows its approach of
+// watching an event history collector's latest page.
+func (vs *Session) WatchVMEvents(ctx context.Context, vm *VirtualMachine, handler func(types.BaseEvent)) error {
+	eventManager := vs.client.Client.ServiceContent.EventManager
+	if eventManager == nil {
+		return errors.New("server has no event manager")
+	}
+	now, err := methods.GetCurrentTime(ctx, vs.client.Client)
+	if err != nil {
+		return err
+	}
+
+	debugf("CreateCollectorForEvents(%s)", vm.Name)
+	res, err := methods.CreateCollectorForEvents(ctx, vs.client.Client, &types.CreateCollectorForEvents{
+		This: *eventManager,
+		Filter: types.EventFilterSpec{
+			Entity: &types.EventFilterSpecByEntity{
+				Entity:    vm.mo.Reference(),
+				Recursion: types.EventFilterSpecRecursionOptionSelf,
+			},
+			Time: &types.EventFilterSpecByTime{BeginTime: now},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	collector := res.Returnval
+	// destroy with a background context as ctx is likely canceled by now
+	defer methods.DestroyCollector(context.Background(), vs.client.Client, &types.DestroyCollector{This: collector})
+
+	// the latest page holds the most recent events, so each update repeats
+	// events already seen
+	var lastKey int32 = -1
+	pc := property.DefaultCollector(vs.client.Client)
+	err = property.Wait(ctx, pc, collector, []string{"latestPage"}, func(changes []types.PropertyChange) bool {
+		for _, c := range changes {
+			if c.Name != "latestPage" || c.Op != types.PropertyChangeOpAssign || c.Val == nil {
+				continue
+			}
+			page, ok := c.Val.(types.ArrayOfEvent)
+			if !ok {
+				continue
+			}
+			// the page is newest first
+			for i := len(page.Event) - 1; i >= 0; i-- {
+				event := page.Event[i]
+				if key := event.GetEvent().Key; key > lastKey {
+					lastKey = key
+					handler(event)
+				}
+			}
+		}
+		return false
+	})
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
@@ -0,0 +1,340 @@
+package vsphere
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+func init() {
+	SetDebug(false)
+}
+
+// fakeVC is a soap.RoundTripper serving a small in-memory inventory, enough
+// for the finder, property collector, container views and tasks
+type fakeVC struct {
+	t *testing.T
+
+	mu       sync.Mutex
+	objects  map[types.ManagedObjectReference]*fakeObject
+	views    map[types.ManagedObjectReference]fakeView
+	filters  map[types.ManagedObjectReference]types.ManagedObjectReference
+	calls    map[string]int
+	faults   map[string][]error
+	requests []interface{}
+	nextID   int
+
+	root, dc, vmFolder, hostFolder, datastoreFolder, networkFolder types.ManagedObjectReference
+}
+
+type fakeObject struct {
+	props    map[string]types.AnyType
+	children []types.ManagedObjectReference
+}
+
+type fakeView struct {
+	container types.ManagedObjectReference
+	types     []string
+	recursive bool
+}
+
+// fakeSubtypes maps a managed object type to its parent type
+var fakeSubtypes = map[string]string{
+	"DistributedVirtualPortgroup":    "Network",
+	"VmwareDistributedVirtualSwitch": "DistributedVirtualSwitch",
+	"ClusterComputeResource":         "ComputeResource",
+}
+
+func newFakeVC(t *testing.T) *fakeVC {
+	f := &fakeVC{
+		t:       t,
+		objects: map[types.ManagedObjectReference]*fakeObject{},
+		views:   map[types.ManagedObjectReference]fakeView{},
+		filters: map[types.ManagedObjectReference]types.ManagedObjectReference{},
+		calls:   map[string]int{},
+		faults:  map[string][]error{},
+	}
+	f.root = f.add(types.ManagedObjectReference{}, "Folder", "Datacenters")
+	f.dc = f.add(f.root, "Datacenter", "dc1")
+	f.vmFolder = f.add(types.ManagedObjectReference{}, "Folder", "vm")
+	f.hostFolder = f.add(types.ManagedObjectReference{}, "Folder", "host")
+	f.datastoreFolder = f.add(types.ManagedObjectReference{}, "Folder", "datastore")
+	f.networkFolder = f.add(types.ManagedObjectReference{}, "Folder", "network")
+	f.set(f.dc, "vmFolder", f.vmFolder)
+	f.set(f.dc, "hostFolder", f.hostFolder)
+	f.set(f.dc, "datastoreFolder", f.datastoreFolder)
+	f.set(f.dc, "networkFolder", f.networkFolder)
+	for _, folder := range []types.ManagedObjectReference{f.vmFolder, f.hostFolder, f.datastoreFolder, f.networkFolder} {
+		f.set(folder, "parent", f.dc)
+	}
+	return f
+}
+
+// session returns a Session using the fake, with the datacenter loaded
+func (f *fakeVC) session() *Session {
+	client := &vim25.Client{
+		RoundTripper: f,
+		ServiceContent: types.ServiceContent{
+			RootFolder:        f.root,
+			PropertyCollector: types.ManagedObjectReference{Type: "PropertyCollector", Value: "propertyCollector"},
+			ViewManager:       &types.ManagedObjectReference{Type: "ViewManager", Value: "ViewManager"},
+		},
+	}
+	vs := &Session{client: &govmomi.Client{Client: client}}
+	dc := object.NewDatacenter(client, f.dc)
+	dc.InventoryPath = "/dc1"
+	vs.datacenter = dc
+	vs.finder = find.NewFinder(client, true)
+	vs.finder.SetDatacenter(dc)
+	return vs
+}
+
+// add creates an object named name in parent, if parent is set
+func (f *fakeVC) add(parent types.ManagedObjectReference, kind, name string) types.ManagedObjectReference {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextID++
+	ref := types.ManagedObjectReference{Type: kind, Value: fmt.Sprintf("%s-%d", strings.ToLower(kind), f.nextID)}
+	f.objects[ref] = &fakeObject{props: map[string]types.AnyType{"name": name}}
+	if parent.Value != "" {
+		f.objects[parent].children = append(f.objects[parent].children, ref)
+		f.objects[ref].props["parent"] = parent
+	}
+	return ref
+}
+
+func (f *fakeVC) set(ref types.ManagedObjectReference, prop string, val types.AnyType) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[ref].props[prop] = val
+}
+
+// addVM creates a VM in folder with the given guestinfo extraConfig
+func (f *fakeVC) addVM(folder types.ManagedObjectReference, name string, extraConfig map[string]string) types.ManagedObjectReference {
+	ref := f.add(folder, "VirtualMachine", name)
+	var opts []types.BaseOptionValue
+	for k, v := range extraConfig {
+		opts = append(opts, &types.OptionValue{Key: k, Value: v})
+	}
+	f.set(ref, "config.extraConfig", types.ArrayOfOptionValue{OptionValue: opts})
+	return ref
+}
+
+// fail makes the next call of method return err
+func (f *fakeVC) fail(method string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults[method] = append(f.faults[method], err)
+}
+
+func (f *fakeVC) count(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[method]
+}
+
+func notAuthenticatedFault() error {
+	fault := &soap.Fault{Code: "ServerFaultCode", String: "The session is not authenticated."}
+	fault.Detail.Fault = types.NotAuthenticated{}
+	return soap.WrapSoapFault(fault)
+}
+
+func isKind(kind, want string) bool {
+	for ; kind != ""; kind = fakeSubtypes[kind] {
+		if kind == want || want == "ManagedEntity" {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeVC) RoundTrip(ctx context.Context, req, res soap.HasFault) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	method := strings.TrimSuffix(reflect.TypeOf(req).Elem().Name(), "Body")
+	f.calls[method]++
+	f.requests = append(f.requests, req)
+	if faults := f.faults[method]; len(faults) > 0 {
+		f.faults[method] = faults[1:]
+		return faults[0]
+	}
+
+	switch r := req.(type) {
+	case *methods.RetrievePropertiesBody:
+		var contents []types.ObjectContent
+		for _, spec := range r.Req.SpecSet {
+			contents = append(contents, f.retrieve(spec)...)
+		}
+		res.(*methods.RetrievePropertiesBody).Res = &types.RetrievePropertiesResponse{Returnval: contents}
+	case *methods.CreateContainerViewBody:
+		ref := f.newRef("ContainerView")
+		f.views[ref] = fakeView{
+			container: r.Req.Container,
+			types:     r.Req.Type,
+			recursive: r.Req.Recursive,
+		}
+		res.(*methods.CreateContainerViewBody).Res = &types.CreateContainerViewResponse{Returnval: ref}
+	case *methods.DestroyViewBody:
+		delete(f.views, r.Req.This)
+		res.(*methods.DestroyViewBody).Res = &types.DestroyViewResponse{}
+	case *methods.CreatePropertyCollectorBody:
+		res.(*methods.CreatePropertyCollectorBody).Res = &types.CreatePropertyCollectorResponse{Returnval: f.newRef("PropertyCollector")}
+	case *methods.DestroyPropertyCollectorBody:
+		res.(*methods.DestroyPropertyCollectorBody).Res = &types.DestroyPropertyCollectorResponse{}
+	case *methods.CreateFilterBody:
+		f.filters[r.Req.This] = r.Req.Spec.ObjectSet[0].Obj
+		res.(*methods.CreateFilterBody).Res = &types.CreateFilterResponse{Returnval: f.newRef("PropertyFilter")}
+	case *methods.WaitForUpdatesExBody:
+		obj := f.filters[r.Req.This]
+		var changes []types.PropertyChange
+		for name, val := range f.objects[obj].props {
+			changes = append(changes, types.PropertyChange{Name: name, Op: types.PropertyChangeOpAssign, Val: val})
+		}
+		res.(*methods.WaitForUpdatesExBody).Res = &types.WaitForUpdatesExResponse{Returnval: &types.UpdateSet{
+			Version: "1",
+			FilterSet: []types.PropertyFilterUpdate{{
+				ObjectSet: []types.ObjectUpdate{{Kind: types.ObjectUpdateKindEnter, Obj: obj, ChangeSet: changes}},
+			}},
+		}}
+	case *methods.CreateVM_TaskBody:
+		f.mu.Unlock()
+		f.addVM(r.Req.This, r.Req.Config.Name, nil)
+		task := f.addTask(types.TaskInfoStateSuccess)
+		f.mu.Lock()
+		res.(*methods.CreateVM_TaskBody).Res = &types.CreateVM_TaskResponse{Returnval: task}
+	case *clearAnnotationBody:
+		f.objects[r.Req.This].props["config.annotation"] = r.Req.Spec.Annotation
+		f.mu.Unlock()
+		task := f.addTask(types.TaskInfoStateSuccess)
+		f.mu.Lock()
+		res.(*clearAnnotationBody).Res = &types.ReconfigVM_TaskResponse{Returnval: task}
+	case *methods.ReconfigVM_TaskBody:
+		if note := r.Req.Spec.Annotation; note != "" {
+			f.objects[r.Req.This].props["config.annotation"] = note
+		}
+		f.mu.Unlock()
+		task := f.addTask(types.TaskInfoStateSuccess)
+		f.mu.Lock()
+		res.(*methods.ReconfigVM_TaskBody).Res = &types.ReconfigVM_TaskResponse{Returnval: task}
+	case *methods.CreateFolderBody:
+		f.mu.Unlock()
+		ref := f.add(r.Req.This, "Folder", r.Req.Name)
+		f.mu.Lock()
+		res.(*methods.CreateFolderBody).Res = &types.CreateFolderResponse{Returnval: ref}
+	case *methods.Rename_TaskBody:
+		f.objects[r.Req.This].props["name"] = r.Req.NewName
+		f.mu.Unlock()
+		task := f.addTask(types.TaskInfoStateSuccess)
+		f.mu.Lock()
+		res.(*methods.Rename_TaskBody).Res = &types.Rename_TaskResponse{Returnval: task}
+	default:
+		f.t.Fatalf("fake vCenter doesn't support %s", method)
+	}
+	return nil
+}
+
+func (f *fakeVC) newRef(kind string) types.ManagedObjectReference {
+	f.nextID++
+	return types.ManagedObjectReference{Type: kind, Value: fmt.Sprintf("%s-%d", strings.ToLower(kind), f.nextID)}
+}
+
+// addTask creates a task that has already finished in state
+func (f *fakeVC) addTask(state types.TaskInfoState) types.ManagedObjectReference {
+	ref := f.add(types.ManagedObjectReference{}, "Task", "task")
+	f.set(ref, "info", types.TaskInfo{Task: ref, State: state})
+	return ref
+}
+
+// retrieve returns the properties spec asks for, following traversals of
+// childEntity, view and reference properties one level and parent to the
+// root
+func (f *fakeVC) retrieve(spec types.PropertyFilterSpec) []types.ObjectContent {
+	var contents []types.ObjectContent
+	for _, os := range spec.ObjectSet {
+		var objs []types.ManagedObjectReference
+		if os.Skip == nil || !*os.Skip {
+			objs = append(objs, os.Obj)
+		}
+		for _, sel := range os.SelectSet {
+			ts, ok := sel.(*types.TraversalSpec)
+			if !ok {
+				continue
+			}
+			switch ts.Path {
+			case "childEntity":
+				objs = append(objs, f.objects[os.Obj].children...)
+			case "view":
+				objs = append(objs, f.viewObjects(f.views[os.Obj])...)
+			case "parent":
+				for ref := os.Obj; ; {
+					parent, ok := f.objects[ref].props["parent"].(types.ManagedObjectReference)
+					if !ok {
+						break
+					}
+					objs = append(objs, parent)
+					ref = parent
+				}
+			default:
+				if ref, ok := f.objects[os.Obj].props[ts.Path].(types.ManagedObjectReference); ok {
+					objs = append(objs, ref)
+				}
+			}
+		}
+		for _, obj := range objs {
+			o, ok := f.objects[obj]
+			if !ok {
+				continue
+			}
+			for _, ps := range spec.PropSet {
+				if !isKind(obj.Type, ps.Type) {
+					continue
+				}
+				content := types.ObjectContent{Obj: obj}
+				paths := ps.PathSet
+				if ps.All != nil && *ps.All {
+					paths = []string{"name", "parent"}
+				}
+				for _, name := range paths {
+					if val, ok := o.props[name]; ok {
+						content.PropSet = append(content.PropSet, types.DynamicProperty{Name: name, Val: val})
+					}
+				}
+				contents = append(contents, content)
+				break
+			}
+		}
+	}
+	return contents
+}
+
+func (f *fakeVC) viewObjects(view fakeView) []types.ManagedObjectReference {
+	var objs []types.ManagedObjectReference
+	var walk func(ref types.ManagedObjectReference)
+	walk = func(ref types.ManagedObjectReference) {
+		for _, child := range f.objects[ref].children {
+			for _, kind := range view.types {
+				if isKind(child.Type, kind) {
+					objs = append(objs, child)
+					break
+				}
+			}
+			if view.recursive {
+				walk(child)
+			}
+		}
+	}
+	walk(view.container)
+	return objs
+}
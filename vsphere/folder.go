@@ -0,0 +1,84 @@
+package vsphere
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/task"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// EnsureFolder returns the VM folder at folderPath, creating any missing
+// folders along the way. folderPath is either an inventory path within the
+// datacenter's VM folder or relative to it, absolute paths outside the VM
+// folder are an error.
+func (vs *Session) EnsureFolder(ctx context.Context, folderPath string) (*object.Folder, error) {
+	finder, err := vs.getFinder(ctx)
+	if err != nil {
+		return nil, err
+	}
+	folder, err := vs.vmFolder(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rel := folderPath
+	if strings.HasPrefix(folderPath, "/") {
+		folderPath = path.Clean(folderPath)
+		if folderPath != folder.InventoryPath && !strings.HasPrefix(folderPath, folder.InventoryPath+"/") {
+			return nil, fmt.Errorf("folder %s is not in the VM folder %s", folderPath, folder.InventoryPath)
+		}
+		rel = strings.TrimPrefix(folderPath, folder.InventoryPath)
+	}
+	for _, name := range strings.Split(rel, "/") {
+		if name == "" {
+			continue
+		}
+		childPath := path.Join(folder.InventoryPath, name)
+		debugf("finder.Folder(%s)", childPath)
+		child, err := finder.Folder(ctx, childPath)
+		if _, ok := err.(*find.NotFoundError); ok {
+			child, err = createFolder(ctx, finder, folder, name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		folder = child
+	}
+	return folder, nil
+}
+
+// createFolder creates the folder name in parent, tolerating another
+// process having created it first
+func createFolder(ctx context.Context, finder *find.Finder, parent *object.Folder, name string) (*object.Folder, error) {
+	childPath := path.Join(parent.InventoryPath, name)
+	debugf("folder.CreateFolder(%s)", childPath)
+	child, err := parent.CreateFolder(ctx, name)
+	if isDuplicateName(err) {
+		debugf("folder %s was created concurrently", childPath)
+		return finder.Folder(ctx, childPath)
+	} else if err != nil {
+		return nil, err
+	}
+	child.SetInventoryPath(childPath)
+	return child, nil
+}
+
+func isDuplicateName(err error) bool {
+	if taskErr, ok := err.(task.Error); ok {
+		_, ok := taskErr.Fault().(*types.DuplicateName)
+		return ok
+	}
+	if soap.IsSoapFault(err) {
+		switch soap.ToSoapFault(err).VimFault().(type) {
+		case types.DuplicateName:
+			return true
+		}
+	}
+	return false
+}
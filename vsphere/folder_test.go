@@ -0,0 +1,40 @@
+package vsphere
+
+import (
+	"context"
+	"testing"
+)
+
+func TestEnsureFolder(t *testing.T) {
+	f := newFakeVC(t)
+	vs := f.session()
+	ctx := context.Background()
+
+	tests := []struct {
+		folderPath string
+		want       string
+	}{
+		{"builds/macos", "/dc1/vm/builds/macos"},
+		{"/dc1/vm/builds/linux", "/dc1/vm/builds/linux"},
+		{"/dc1/vm", "/dc1/vm"},
+	}
+	for _, test := range tests {
+		folder, err := vs.EnsureFolder(ctx, test.folderPath)
+		if err != nil {
+			t.Errorf("EnsureFolder(%s): %s", test.folderPath, err)
+			continue
+		}
+		if folder.InventoryPath != test.want {
+			t.Errorf("EnsureFolder(%s) = %s, want %s", test.folderPath, folder.InventoryPath, test.want)
+		}
+	}
+	if n := f.count("CreateFolder"); n != 3 {
+		t.Errorf("CreateFolder called %d times, want 3", n)
+	}
+
+	for _, folderPath := range []string{"/dc1/vmkite-ci", "/dc2/vm/builds"} {
+		if _, err := vs.EnsureFolder(ctx, folderPath); err == nil {
+			t.Errorf("EnsureFolder(%s) succeeded outside the VM folder", folderPath)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package vsphere
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const guestPollInterval = time.Second * 2
+
+// ErrWaitTimeout is returned when a VM doesn't reach the awaited state in time
+var ErrWaitTimeout = errors.New("timed out waiting for vm")
+
+// ErrToolsNotRunning is returned when an operation needs VMware Tools running
+// in the guest
+var ErrToolsNotRunning = errors.New("vmware tools is not running in the guest")
+
+// WaitForIP polls until the guest reports a routable IP address
+func (vm *VirtualMachine) WaitForIP(ctx context.Context, timeout time.Duration) (string, error) {
+	return vm.waitForIP(ctx, timeout, false)
+}
+
+// WaitForIPv4 polls until the guest reports a routable IPv4 address
+func (vm *VirtualMachine) WaitForIPv4(ctx context.Context, timeout time.Duration) (string, error) {
+	return vm.waitForIP(ctx, timeout, true)
+}
+
+func (vm *VirtualMachine) waitForIP(ctx context.Context, timeout time.Duration, v4 bool) (string, error) {
+	debugf("vm.WaitForIP(%s)", vm.Name)
+	var ip string
+	err := vm.poll(ctx, timeout, func() (bool, error) {
+		var mvm mo.VirtualMachine
+		pc := property.DefaultCollector(vm.vs.client.Client)
+		err := pc.RetrieveOne(ctx, vm.mo.Reference(), []string{"guest.ipAddress", "guest.net"}, &mvm)
+		if err != nil {
+			return false, err
+		}
+		if mvm.Guest == nil {
+			return false, nil
+		}
+		candidates := []string{mvm.Guest.IpAddress}
+		for _, nic := range mvm.Guest.Net {
+			candidates = append(candidates, nic.IpAddress...)
+		}
+		for _, addr := range candidates {
+			if usableIP(addr, v4) {
+				ip = addr
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	debugf("vm %s has ip %s", vm.Name, ip)
+	return ip, nil
+}
+
+// WaitForTools polls until VMware Tools is running in the guest
+func (vm *VirtualMachine) WaitForTools(ctx context.Context, timeout time.Duration) error {
+	debugf("vm.WaitForTools(%s)", vm.Name)
+	err := vm.poll(ctx, timeout, func() (bool, error) {
+		var mvm mo.VirtualMachine
+		pc := property.DefaultCollector(vm.vs.client.Client)
+		err := pc.RetrieveOne(ctx, vm.mo.Reference(), []string{"guest.toolsRunningStatus"}, &mvm)
+		if err != nil {
+			return false, err
+		}
+		return mvm.Guest != nil &&
+			mvm.Guest.ToolsRunningStatus == string(types.VirtualMachineToolsRunningStatusGuestToolsRunning), nil
+	})
+	if err != nil {
+		return err
+	}
+	debugf("vm %s has tools running", vm.Name)
+	return nil
+}
+
+// GuestInfo returns the VM's guestinfo extraConfig values, keyed without the
+// guestinfo. prefix
+func (vm *VirtualMachine) GuestInfo(ctx context.Context) (map[string]string, error) {
+	debugf("vm.GuestInfo(%s)", vm.Name)
+	var mvm mo.VirtualMachine
+	pc := property.DefaultCollector(vm.vs.client.Client)
+	err := pc.RetrieveOne(ctx, vm.mo.Reference(), []string{"config.extraConfig"}, &mvm)
+	if err != nil {
+		return nil, err
+	}
+	info := make(map[string]string)
+	if mvm.Config == nil {
+		return info, nil
+	}
+	for _, opt := range mvm.Config.ExtraConfig {
+		ov := opt.GetOptionValue()
+		if strings.HasPrefix(ov.Key, "guestinfo.") {
+			info[strings.TrimPrefix(ov.Key, "guestinfo.")] = fmt.Sprint(ov.Value)
+		}
+	}
+	return info, nil
+}
+
+// SetGuestInfo sets guestinfo extraConfig values on the VM, which may be
+// powered on. Keys are given without the guestinfo. prefix, and existing keys
+// not in kv are left unchanged.
+func (vm *VirtualMachine) SetGuestInfo(ctx context.Context, kv map[string]string) error {
+	if len(kv) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(kv))
+	for key := range kv {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var extraConfig []types.BaseOptionValue
+	for _, key := range keys {
+		debugf("setting %s guestinfo.%s=%q", vm.Name, key, kv[key])
+		extraConfig = append(extraConfig,
+			&types.OptionValue{Key: "guestinfo." + key, Value: kv[key]},
+		)
+	}
+	return vm.Reconfigure(ctx, types.VirtualMachineConfigSpec{ExtraConfig: extraConfig})
+}
+
+// GuestAuth is the guest OS account guest operations run as
+type GuestAuth struct {
+	Username string
+	Password string
+}
+
+// RunGuestCommand starts program with args in the guest using VMware Tools,
+// returning the guest process ID without waiting for it to exit
+func (vm *VirtualMachine) RunGuestCommand(ctx context.Context, auth GuestAuth, program, args string) (int64, error) {
+	client := vm.vs.client.Client
+	if client.ServiceContent.GuestOperationsManager == nil {
+		return 0, errors.New("server has no guest operations manager")
+	}
+	var gom mo.GuestOperationsManager
+	pc := property.DefaultCollector(client)
+	err := pc.RetrieveOne(ctx, *client.ServiceContent.GuestOperationsManager, []string{"processManager"}, &gom)
+	if err != nil {
+		return 0, err
+	}
+	if gom.ProcessManager == nil {
+		return 0, errors.New("server has no guest process manager")
+	}
+
+	debugf("processManager.StartProgramInGuest(%s, %s %s)", vm.Name, program, args)
+	res, err := methods.StartProgramInGuest(ctx, client, &types.StartProgramInGuest{
+		This: *gom.ProcessManager,
+		Vm:   vm.mo.Reference(),
+		Auth: &types.NamePasswordAuthentication{
+			Username: auth.Username,
+			Password: auth.Password,
+		},
+		Spec: &types.GuestProgramSpec{
+			ProgramPath: program,
+			Arguments:   args,
+		},
+	})
+	if err != nil {
+		if isToolsUnavailable(err) {
+			return 0, ErrToolsNotRunning
+		}
+		return 0, err
+	}
+	debugf("started guest process %d on vm %s", res.Returnval, vm.Name)
+	return res.Returnval, nil
+}
+
+func usableIP(addr string, v4 bool) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+		return false
+	}
+	return !v4 || ip.To4() != nil
+}
+
+// poll calls check every PollInterval until it returns true or an error,
+// returning ErrWaitTimeout if timeout passes first
+func (vm *VirtualMachine) poll(ctx context.Context, timeout time.Duration, check func() (bool, error)) error {
+	interval := vm.PollInterval
+	if interval <= 0 {
+		interval = guestPollInterval
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		done, err := check()
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-timer.C:
+			return ErrWaitTimeout
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
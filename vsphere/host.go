@@ -0,0 +1,133 @@
+package vsphere
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// PickHost returns the connected host in the cluster with the fewest VMs,
+// breaking ties on the lowest CPU usage. Hosts in maintenance mode are skipped.
+func (vs *Session) PickHost(ctx context.Context, clusterPath string) (*object.HostSystem, error) {
+	finder, err := vs.getFinder(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cluster, err := vs.findCluster(ctx, finder, clusterPath)
+	if err != nil {
+		return nil, err
+	}
+	debugf("cluster.Hosts()")
+	hosts, err := cluster.Hosts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("cluster %s has no hosts", clusterPath)
+	}
+
+	refs := make([]types.ManagedObjectReference, len(hosts))
+	for i, host := range hosts {
+		refs[i] = host.Reference()
+	}
+	var mhosts []mo.HostSystem
+	pc := property.DefaultCollector(vs.client.Client)
+	err = pc.Retrieve(ctx, refs, []string{
+		"name",
+		"vm",
+		"runtime.connectionState",
+		"runtime.inMaintenanceMode",
+		"summary.quickStats.overallCpuUsage",
+	}, &mhosts)
+	if err != nil {
+		return nil, err
+	}
+
+	var best *mo.HostSystem
+	for i := range mhosts {
+		h := &mhosts[i]
+		if h.Runtime.ConnectionState != types.HostSystemConnectionStateConnected || h.Runtime.InMaintenanceMode {
+			debugf("skipping host %s (%s, maintenance=%t)",
+				h.Name, h.Runtime.ConnectionState, h.Runtime.InMaintenanceMode)
+			continue
+		}
+		debugf("host %s has %d vms, %dMHz cpu used",
+			h.Name, len(h.Vm), h.Summary.QuickStats.OverallCpuUsage)
+		if best == nil ||
+			len(h.Vm) < len(best.Vm) ||
+			(len(h.Vm) == len(best.Vm) && h.Summary.QuickStats.OverallCpuUsage < best.Summary.QuickStats.OverallCpuUsage) {
+			best = h
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("no available hosts in cluster %s", clusterPath)
+	}
+
+	for _, host := range hosts {
+		if host.Reference() == best.Reference() {
+			debugf("picked host %s", best.Name)
+			return host, nil
+		}
+	}
+	return nil, fmt.Errorf("host %s not found in cluster %s", best.Name, clusterPath)
+}
+
+// HostCapacity is a host's CPU and memory capacity and usage
+type HostCapacity struct {
+	TotalCPUMHz   int64
+	UsedCPUMHz    int64
+	TotalMemoryMB int64
+	UsedMemoryMB  int64
+	PoweredOnVMs  int
+}
+
+// HostCapacity reads the capacity and current usage of the host at hostPath,
+// along with how many of its VMs are powered on
+func (vs *Session) HostCapacity(ctx context.Context, hostPath string) (HostCapacity, error) {
+	finder, err := vs.getFinder(ctx)
+	if err != nil {
+		return HostCapacity{}, err
+	}
+	debugf("finder.HostSystem(%s)", hostPath)
+	host, err := finder.HostSystem(ctx, hostPath)
+	if err != nil {
+		return HostCapacity{}, wrapNotFound(err, ErrHostNotFound, hostPath)
+	}
+
+	var mhost mo.HostSystem
+	pc := property.DefaultCollector(vs.client.Client)
+	err = pc.RetrieveOne(ctx, host.Reference(), []string{"vm", "summary.hardware", "summary.quickStats"}, &mhost)
+	if err != nil {
+		return HostCapacity{}, err
+	}
+	if mhost.Summary.Hardware == nil {
+		return HostCapacity{}, fmt.Errorf("host %s has no hardware summary", hostPath)
+	}
+	hw := mhost.Summary.Hardware
+	capacity := HostCapacity{
+		TotalCPUMHz:   int64(hw.CpuMhz) * int64(hw.NumCpuCores),
+		UsedCPUMHz:    int64(mhost.Summary.QuickStats.OverallCpuUsage),
+		TotalMemoryMB: hw.MemorySize / 1024 / 1024,
+		UsedMemoryMB:  int64(mhost.Summary.QuickStats.OverallMemoryUsage),
+	}
+
+	if len(mhost.Vm) > 0 {
+		var mvms []mo.VirtualMachine
+		if err := pc.Retrieve(ctx, mhost.Vm, []string{"runtime.powerState"}, &mvms); err != nil {
+			return HostCapacity{}, err
+		}
+		for _, mvm := range mvms {
+			if mvm.Runtime.PowerState == types.VirtualMachinePowerStatePoweredOn {
+				capacity.PoweredOnVMs++
+			}
+		}
+	}
+	debugf("host %s has %d/%dMHz cpu and %d/%dMB memory used, %d vms powered on",
+		hostPath, capacity.UsedCPUMHz, capacity.TotalCPUMHz,
+		capacity.UsedMemoryMB, capacity.TotalMemoryMB, capacity.PoweredOnVMs)
+	return capacity, nil
+}
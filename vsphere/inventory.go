@@ -0,0 +1,96 @@
+package vsphere
+
+import (
+	"context"
+	"path"
+	"sort"
+
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+)
+
+// Inventory lists what's available in the datacenter, in the form
+// VirtualMachineCreationParams expects: clusters and hosts by inventory path,
+// datastores and networks by name
+type Inventory struct {
+	Datacenter string
+	Clusters   []string
+	Hosts      []string
+	Datastores []string
+	Networks   []string
+}
+
+// InventorySummary lists the clusters, hosts, datastores and networks in the
+// session's datacenter
+func (vs *Session) InventorySummary(ctx context.Context) (inv Inventory, err error) {
+	err = vs.withReauth(ctx, func() error {
+		inv, err = vs.inventorySummary(ctx)
+		return err
+	})
+	return
+}
+
+func (vs *Session) inventorySummary(ctx context.Context) (Inventory, error) {
+	var inv Inventory
+	finder, err := vs.getFinder(ctx)
+	if err != nil {
+		return inv, err
+	}
+	inv.Datacenter = vs.datacenter.InventoryPath
+
+	debugf("finder.ClusterComputeResourceList(*)")
+	clusters, err := finder.ClusterComputeResourceList(ctx, "*")
+	if err := ignoreNotFound(err); err != nil {
+		return inv, err
+	}
+	for _, cluster := range clusters {
+		inv.Clusters = append(inv.Clusters, cluster.InventoryPath)
+	}
+
+	// hosts are children of their cluster or standalone compute resource
+	debugf("finder.HostSystemList(*/*)")
+	hosts, err := finder.HostSystemList(ctx, "*/*")
+	if err := ignoreNotFound(err); err != nil {
+		return inv, err
+	}
+	for _, host := range hosts {
+		inv.Hosts = append(inv.Hosts, host.InventoryPath)
+	}
+
+	debugf("finder.DatastoreList(*)")
+	datastores, err := finder.DatastoreList(ctx, "*")
+	if err := ignoreNotFound(err); err != nil {
+		return inv, err
+	}
+	for _, ds := range datastores {
+		inv.Datastores = append(inv.Datastores, ds.Name())
+	}
+
+	debugf("finder.NetworkList(*)")
+	networks, err := finder.NetworkList(ctx, "*")
+	if err := ignoreNotFound(err); err != nil {
+		return inv, err
+	}
+	for _, network := range networks {
+		switch n := network.(type) {
+		case *object.Network:
+			inv.Networks = append(inv.Networks, path.Base(n.InventoryPath))
+		case *object.DistributedVirtualPortgroup:
+			inv.Networks = append(inv.Networks, path.Base(n.InventoryPath))
+		}
+	}
+
+	sort.Strings(inv.Clusters)
+	sort.Strings(inv.Hosts)
+	sort.Strings(inv.Datastores)
+	sort.Strings(inv.Networks)
+	return inv, nil
+}
+
+// ignoreNotFound treats a finder's not found error as an empty list
+func ignoreNotFound(err error) error {
+	if _, ok := err.(*find.NotFoundError); ok {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,46 @@
+package vsphere
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/vmware/govmomi/object"
+)
+
+func TestFindNetwork(t *testing.T) {
+	f := newFakeVC(t)
+	f.add(f.networkFolder, "Network", "VM Network")
+	f.add(f.networkFolder, "VmwareDistributedVirtualSwitch", "dvs1")
+	f.add(f.networkFolder, "DistributedVirtualPortgroup", "dvpg-builds")
+	f.add(f.networkFolder, "DistributedVirtualPortgroup", "dvpg-shared")
+	f.add(f.networkFolder, "DistributedVirtualPortgroup", "other-dvpg-shared")
+
+	vs := f.session()
+	finder := vs.finder
+	ctx := context.Background()
+
+	network, err := findNetwork(ctx, finder, "VM Network")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := network.(*object.Network); !ok {
+		t.Errorf("VM Network resolved to %T, want *object.Network", network)
+	}
+
+	network, err = findNetwork(ctx, finder, "dvpg-builds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := network.(*object.DistributedVirtualPortgroup); !ok {
+		t.Errorf("dvpg-builds resolved to %T, want *object.DistributedVirtualPortgroup", network)
+	}
+
+	if _, err = findNetwork(ctx, finder, "dvs1"); !errors.Is(err, ErrNetworkNotFound) {
+		t.Errorf("dvs1 resolved with error %v, want ErrNetworkNotFound", err)
+	}
+
+	if _, err = findNetwork(ctx, finder, "dvpg-shared"); err == nil {
+		t.Error("ambiguous port group label resolved without an error")
+	}
+}
@@ -0,0 +1,222 @@
+package vsphere
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// pbmClient is a minimal client for the Storage Policy (SPBM) API, which
+// vmkite's govmomi has no bindings for. It's SOAP like vim25 but served from
+// /pbm and authenticated with the vim25 session cookie in a SOAP header,
+// which soap.Client can't send, so requests are built by hand.
+type pbmClient struct {
+	url        *url.URL
+	client     *http.Client
+	soapClient *soap.Client
+
+	mu             sync.Mutex
+	profileManager *pbmRef
+}
+
+func newPBMClient(soapClient *soap.Client) *pbmClient {
+	u := soapClient.URL()
+	u.User = nil
+	u.Path = "/pbm"
+	return &pbmClient{
+		url:        u,
+		client:     &http.Client{Transport: soapClient.Client.Transport},
+		soapClient: soapClient,
+	}
+}
+
+type pbmRef struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type pbmProfileID struct {
+	UniqueID string `xml:"uniqueId"`
+}
+
+type pbmRetrieveServiceContent struct {
+	XMLName xml.Name `xml:"urn:pbm PbmRetrieveServiceContent"`
+	This    pbmRef   `xml:"_this"`
+}
+
+type pbmQueryProfile struct {
+	XMLName         xml.Name `xml:"urn:pbm PbmQueryProfile"`
+	This            pbmRef   `xml:"_this"`
+	ResourceType    string   `xml:"resourceType>resourceType"`
+	ProfileCategory string   `xml:"profileCategory"`
+}
+
+type pbmRetrieveContent struct {
+	XMLName    xml.Name       `xml:"urn:pbm PbmRetrieveContent"`
+	This       pbmRef         `xml:"_this"`
+	ProfileIds []pbmProfileID `xml:"profileIds"`
+}
+
+// sessionCookie returns the vim25 session cookie the PBM api authenticates
+// with
+func (p *pbmClient) sessionCookie() (string, error) {
+	for _, cookie := range p.soapClient.Jar.Cookies(p.soapClient.URL()) {
+		if cookie.Name == "vmware_soap_session" {
+			return cookie.Value, nil
+		}
+	}
+	return "", errors.New("no vSphere session cookie for the storage policy api")
+}
+
+// call sends body in a SOAP envelope and decodes the response element into
+// out
+func (p *pbmClient) call(ctx context.Context, body, out interface{}) error {
+	cookie, err := p.sessionCookie()
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	buf.WriteString(`<Envelope xmlns="http://schemas.xmlsoap.org/soap/envelope/"><Header><vcSessionCookie>`)
+	if err := xml.EscapeText(&buf, []byte(cookie)); err != nil {
+		return err
+	}
+	buf.WriteString(`</vcSessionCookie></Header><Body>`)
+	if err := xml.NewEncoder(&buf).Encode(body); err != nil {
+		return err
+	}
+	buf.WriteString(`</Body></Envelope>`)
+
+	req, err := http.NewRequest("POST", p.url.String(), &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", "urn:pbm/"+p.soapClient.Version)
+	res, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	var env struct {
+		Body struct {
+			Fault *struct {
+				Code   string `xml:"faultcode"`
+				String string `xml:"faultstring"`
+			} `xml:"Fault"`
+			Content []byte `xml:",innerxml"`
+		} `xml:"Body"`
+	}
+	if err := xml.Unmarshal(data, &env); err != nil {
+		return fmt.Errorf("pbm: %s: %s", res.Status, err)
+	}
+	if env.Body.Fault != nil {
+		return fmt.Errorf("pbm: %s: %s", env.Body.Fault.Code, env.Body.Fault.String)
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("pbm: %s", res.Status)
+	}
+	return xml.Unmarshal(env.Body.Content, out)
+}
+
+// serviceContent returns the profile manager, retrieving it once
+func (p *pbmClient) serviceContent(ctx context.Context) (pbmRef, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.profileManager != nil {
+		return *p.profileManager, nil
+	}
+	var res struct {
+		ProfileManager pbmRef `xml:"returnval>profileManager"`
+	}
+	req := pbmRetrieveServiceContent{
+		This: pbmRef{Type: "PbmServiceInstance", Value: "ServiceInstance"},
+	}
+	if err := p.call(ctx, req, &res); err != nil {
+		return pbmRef{}, err
+	}
+	p.profileManager = &res.ProfileManager
+	return res.ProfileManager, nil
+}
+
+// findProfile returns the id of the storage policy named name
+func (p *pbmClient) findProfile(ctx context.Context, name string) (string, error) {
+	profileManager, err := p.serviceContent(ctx)
+	if err != nil {
+		return "", err
+	}
+	var ids struct {
+		Returnval []pbmProfileID `xml:"returnval"`
+	}
+	err = p.call(ctx, pbmQueryProfile{
+		This:            profileManager,
+		ResourceType:    "STORAGE",
+		ProfileCategory: "REQUIREMENT",
+	}, &ids)
+	if err != nil {
+		return "", err
+	}
+	if len(ids.Returnval) == 0 {
+		return "", fmt.Errorf("storage policy %s not found", name)
+	}
+	var profiles struct {
+		Returnval []struct {
+			ProfileID pbmProfileID `xml:"profileId"`
+			Name      string       `xml:"name"`
+		} `xml:"returnval"`
+	}
+	err = p.call(ctx, pbmRetrieveContent{
+		This:       profileManager,
+		ProfileIds: ids.Returnval,
+	}, &profiles)
+	if err != nil {
+		return "", err
+	}
+	for _, profile := range profiles.Returnval {
+		if strings.EqualFold(profile.Name, name) {
+			return profile.ProfileID.UniqueID, nil
+		}
+	}
+	return "", fmt.Errorf("storage policy %s not found", name)
+}
+
+// applyStoragePolicy attaches the storage policy named name to the VM's home
+// and each disk created or added by cs
+func (vs *Session) applyStoragePolicy(ctx context.Context, cs *types.VirtualMachineConfigSpec, name string) error {
+	if vs.pbm == nil {
+		return errors.New("storage policies require a connected session")
+	}
+	debugf("pbm.findProfile(%s)", name)
+	id, err := vs.pbm.findProfile(ctx, name)
+	if err != nil {
+		return err
+	}
+	profile := func() []types.BaseVirtualMachineProfileSpec {
+		return []types.BaseVirtualMachineProfileSpec{
+			&types.VirtualMachineDefinedProfileSpec{ProfileId: id},
+		}
+	}
+	cs.VmProfile = profile()
+	for _, change := range cs.DeviceChange {
+		spec := change.GetVirtualDeviceConfigSpec()
+		if _, ok := spec.Device.(*types.VirtualDisk); ok {
+			spec.Profile = profile()
+		}
+	}
+	return nil
+}
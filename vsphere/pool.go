@@ -0,0 +1,50 @@
+package vsphere
+
+import (
+	"context"
+	"path"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// CreateResourcePool creates a child resource pool named name under the pool
+// at parentPath, capped at cpuLimitMHz and memLimitMB. A limit of zero or
+// less leaves that resource unlimited. The new pool's path can be passed as
+// ResourcePoolPath to CreateVM.
+func (vs *Session) CreateResourcePool(ctx context.Context, parentPath, name string, cpuLimitMHz, memLimitMB int64) (*object.ResourcePool, error) {
+	finder, err := vs.getFinder(ctx)
+	if err != nil {
+		return nil, err
+	}
+	parent, err := vs.findResourcePool(ctx, finder, parentPath)
+	if err != nil {
+		return nil, err
+	}
+	spec := types.ResourceConfigSpec{
+		CpuAllocation:    poolAllocation(cpuLimitMHz),
+		MemoryAllocation: poolAllocation(memLimitMB),
+	}
+	debugf("pool.Create(%s, %s, cpu=%dMHz, mem=%dMB)", parentPath, name, cpuLimitMHz, memLimitMB)
+	pool, err := parent.Create(ctx, name, spec)
+	if err != nil {
+		return nil, err
+	}
+	pool.InventoryPath = path.Join(parent.InventoryPath, name)
+	return pool, nil
+}
+
+// poolAllocation returns an expandable allocation with normal shares, capped
+// at limit if it's positive
+func poolAllocation(limit int64) *types.ResourceAllocationInfo {
+	if limit <= 0 {
+		limit = -1
+	}
+	return &types.ResourceAllocationInfo{
+		ExpandableReservation: types.NewBool(true),
+		Limit:                 limit,
+		Shares: &types.SharesInfo{
+			Level: types.SharesLevelNormal,
+		},
+	}
+}
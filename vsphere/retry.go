@@ -0,0 +1,125 @@
+package vsphere
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/vmware/govmomi/task"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// RetryPolicy controls how operations failing with a transient vCenter fault
+// are retried
+type RetryPolicy struct {
+	// MaxRetries is how many times a failed operation is retried, zero
+	// disables retrying
+	MaxRetries int
+
+	// MinBackoff is the wait before the first retry, doubling on each retry
+	MinBackoff time.Duration
+
+	// MaxBackoff caps the wait between retries
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy retries transient faults up to 3 times
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries: 3,
+	MinBackoff: time.Second * 2,
+	MaxBackoff: time.Second * 30,
+}
+
+// withRetry calls fn, retrying it with exponential backoff while it fails
+// with a transient fault, up to the session's RetryPolicy
+func (vs *Session) withRetry(ctx context.Context, op string, fn func() error) error {
+	backoff := vs.retry.MinBackoff
+	if backoff <= 0 {
+		backoff = DefaultRetryPolicy.MinBackoff
+	}
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if nr, ok := err.(notRetryable); ok {
+			return nr.error
+		}
+		if err == nil || !isTransient(err) || attempt >= vs.retry.MaxRetries {
+			return err
+		}
+
+		wait := backoff
+		if vs.retry.MaxBackoff > 0 && wait > vs.retry.MaxBackoff {
+			wait = vs.retry.MaxBackoff
+		}
+		warnf("%s failed with a transient error: %s, retrying in %v (%d/%d)",
+			op, err, wait, attempt+1, vs.retry.MaxRetries)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// notRetryable wraps an error withRetry returns as-is, even if it's transient
+type notRetryable struct {
+	error
+}
+
+// submittedTaskError returns err from waiting for a task that creates
+// something, keeping it retryable only if the task itself failed. If waiting
+// failed the task may still have succeeded, and resubmitting it could create
+// a duplicate.
+func submittedTaskError(err error) error {
+	if _, ok := err.(task.Error); ok || err == nil {
+		return err
+	}
+	return notRetryable{err}
+}
+
+// isTransient reports whether err is a fault vCenter raises when it's busy,
+// e.g. during vMotion storms, as opposed to one that retrying won't fix
+func isTransient(err error) bool {
+	if taskErr, ok := err.(task.Error); ok {
+		switch taskErr.Fault().(type) {
+		case *types.SystemError, *types.TaskInProgress, *types.ConcurrentAccess,
+			*types.HostCommunication, *types.HostNotConnected:
+			return true
+		}
+		return false
+	}
+	if soap.IsSoapFault(err) {
+		fault := soap.ToSoapFault(err)
+		switch fault.VimFault().(type) {
+		case types.SystemError, types.TaskInProgress, types.ConcurrentAccess,
+			types.HostCommunication, types.HostNotConnected:
+			return true
+		}
+		return false
+	}
+	return errors.Is(err, errServiceUnavailable)
+}
+
+// errServiceUnavailable is returned for a 503 response, which vCenter sends
+// while its services are restarting
+var errServiceUnavailable = errors.New(http.StatusText(http.StatusServiceUnavailable))
+
+// unavailableTransport turns 503 responses into errServiceUnavailable, so
+// isTransient can tell them apart from other failed requests
+type unavailableTransport struct {
+	http.RoundTripper
+}
+
+func (t unavailableTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.RoundTripper.RoundTrip(req)
+	if err == nil && res.StatusCode == http.StatusServiceUnavailable {
+		res.Body.Close()
+		return nil, errServiceUnavailable
+	}
+	return res, err
+}
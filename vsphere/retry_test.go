@@ -0,0 +1,58 @@
+package vsphere
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+func TestIsTransient(t *testing.T) {
+	systemError := &soap.Fault{Code: "ServerFaultCode"}
+	systemError.Detail.Fault = types.SystemError{}
+	invalidArgument := &soap.Fault{Code: "ServerFaultCode"}
+	invalidArgument.Detail.Fault = types.InvalidArgument{}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"system error", soap.WrapSoapFault(systemError), true},
+		{"invalid argument", soap.WrapSoapFault(invalidArgument), false},
+		{"bare server fault", soap.WrapSoapFault(&soap.Fault{Code: "ServerFaultCode"}), false},
+		{"503 status text", errors.New("503 Service Unavailable"), false},
+	}
+	for _, test := range tests {
+		if got := isTransient(test.err); got != test.want {
+			t.Errorf("isTransient(%s) = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestUnavailableTransport(t *testing.T) {
+	status := http.StatusServiceUnavailable
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	client := &http.Client{Transport: unavailableTransport{http.DefaultTransport}}
+
+	_, err := client.Get(server.URL)
+	if !isTransient(err) {
+		t.Errorf("503 response gave error %v, want a transient error", err)
+	}
+
+	status = http.StatusBadGateway
+	res, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadGateway {
+		t.Errorf("got status %d, want %d", res.StatusCode, http.StatusBadGateway)
+	}
+}
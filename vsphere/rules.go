@@ -0,0 +1,98 @@
+package vsphere
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// CreateAntiAffinityRule adds a DRS rule to the cluster at clusterPath that
+// keeps vms on separate hosts
+func (vs *Session) CreateAntiAffinityRule(ctx context.Context, clusterPath, ruleName string, vms []*VirtualMachine) error {
+	if len(vms) < 2 {
+		return fmt.Errorf("anti-affinity rule %s needs at least two vms", ruleName)
+	}
+	cluster, err := vs.clusterForRules(ctx, clusterPath)
+	if err != nil {
+		return err
+	}
+	refs := make([]types.ManagedObjectReference, len(vms))
+	for i, vm := range vms {
+		refs[i] = vm.mo.Reference()
+	}
+	enabled := true
+	spec := types.ClusterConfigSpec{
+		RulesSpec: []types.ClusterRuleSpec{{
+			ArrayUpdateSpec: types.ArrayUpdateSpec{
+				Operation: types.ArrayUpdateOperationAdd,
+			},
+			Info: &types.ClusterAntiAffinityRuleSpec{
+				ClusterRuleInfo: types.ClusterRuleInfo{
+					Name:    ruleName,
+					Enabled: &enabled,
+				},
+				Vm: refs,
+			},
+		}},
+	}
+	debugf("cluster.ReconfigureCluster(%s, add anti-affinity rule %s for %d vms)", clusterPath, ruleName, len(vms))
+	return vs.reconfigureCluster(ctx, cluster, spec)
+}
+
+// DeleteAntiAffinityRule removes the DRS rule named ruleName from the cluster
+// at clusterPath
+func (vs *Session) DeleteAntiAffinityRule(ctx context.Context, clusterPath, ruleName string) error {
+	cluster, err := vs.clusterForRules(ctx, clusterPath)
+	if err != nil {
+		return err
+	}
+	var mcluster mo.ClusterComputeResource
+	pc := property.DefaultCollector(vs.client.Client)
+	if err := pc.RetrieveOne(ctx, cluster.Reference(), []string{"configurationEx"}, &mcluster); err != nil {
+		return err
+	}
+	config, ok := mcluster.ConfigurationEx.(*types.ClusterConfigInfoEx)
+	if !ok {
+		return fmt.Errorf("cluster %s has no rule configuration", clusterPath)
+	}
+	for _, r := range config.Rule {
+		rule, ok := r.(*types.ClusterAntiAffinityRuleSpec)
+		if !ok || rule.Name != ruleName {
+			continue
+		}
+		spec := types.ClusterConfigSpec{
+			RulesSpec: []types.ClusterRuleSpec{{
+				ArrayUpdateSpec: types.ArrayUpdateSpec{
+					Operation: types.ArrayUpdateOperationRemove,
+					RemoveKey: rule.Key,
+				},
+			}},
+		}
+		debugf("cluster.ReconfigureCluster(%s, remove anti-affinity rule %s)", clusterPath, ruleName)
+		return vs.reconfigureCluster(ctx, cluster, spec)
+	}
+	return fmt.Errorf("anti-affinity rule %s not found in cluster %s", ruleName, clusterPath)
+}
+
+func (vs *Session) clusterForRules(ctx context.Context, clusterPath string) (*object.ClusterComputeResource, error) {
+	finder, err := vs.getFinder(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return vs.findCluster(ctx, finder, clusterPath)
+}
+
+func (vs *Session) reconfigureCluster(ctx context.Context, cluster *object.ClusterComputeResource, spec types.ClusterConfigSpec) error {
+	return vs.withRetry(ctx, "ReconfigureCluster "+cluster.Name(), func() error {
+		task, err := cluster.ReconfigureCluster(ctx, spec)
+		if err != nil {
+			return err
+		}
+		debugf("waiting for ReconfigureCluster %v", task)
+		return task.Wait(ctx)
+	})
+}
@@ -0,0 +1,163 @@
+package vsphere
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// Snapshot is a named snapshot of a VirtualMachine
+type Snapshot struct {
+	Name string
+	Ref  types.ManagedObjectReference
+}
+
+// SnapshotInfo describes a snapshot listed with ListSnapshots
+type SnapshotInfo struct {
+	Name        string
+	Description string
+	CreateTime  time.Time
+	Current     bool
+	Ref         types.ManagedObjectReference
+
+	// Parent is the reference of the parent snapshot, nil for root snapshots
+	Parent *types.ManagedObjectReference
+}
+
+// ListSnapshots returns all the VM's snapshots, flattening the snapshot tree
+// with each snapshot before its children
+func (vm *VirtualMachine) ListSnapshots(ctx context.Context) ([]SnapshotInfo, error) {
+	debugf("vm.ListSnapshots(%s)", vm.Name)
+	var mvm mo.VirtualMachine
+	if err := vm.mo.Properties(ctx, vm.mo.Reference(), []string{"snapshot"}, &mvm); err != nil {
+		return nil, err
+	}
+	snapshots := []SnapshotInfo{}
+	if mvm.Snapshot == nil {
+		return snapshots, nil
+	}
+	var walk func(trees []types.VirtualMachineSnapshotTree, parent *types.ManagedObjectReference)
+	walk = func(trees []types.VirtualMachineSnapshotTree, parent *types.ManagedObjectReference) {
+		for i := range trees {
+			tree := &trees[i]
+			snapshots = append(snapshots, SnapshotInfo{
+				Name:        tree.Name,
+				Description: tree.Description,
+				CreateTime:  tree.CreateTime,
+				Current:     mvm.Snapshot.CurrentSnapshot != nil && *mvm.Snapshot.CurrentSnapshot == tree.Snapshot,
+				Ref:         tree.Snapshot,
+				Parent:      parent,
+			})
+			walk(tree.ChildSnapshotList, &tree.Snapshot)
+		}
+	}
+	walk(mvm.Snapshot.RootSnapshotList, nil)
+	return snapshots, nil
+}
+
+// CreateSnapshot snapshots the VM and waits for the task to complete
+func (vm *VirtualMachine) CreateSnapshot(ctx context.Context, name, description string, memory, quiesce bool) (*Snapshot, error) {
+	debugf("vm.CreateSnapshot(%s, %s)", vm.Name, name)
+	var info *types.TaskInfo
+	err := vm.vs.withRetry(ctx, "CreateSnapshot "+vm.Name, func() error {
+		task, err := vm.mo.CreateSnapshot(ctx, name, description, memory, quiesce)
+		if err != nil {
+			return err
+		}
+		debugf("waiting for CreateSnapshot %v", task)
+		info, err = task.WaitForResult(ctx, nil)
+		return submittedTaskError(err)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Snapshot{
+		Name: name,
+		Ref:  info.Result.(types.ManagedObjectReference),
+	}, nil
+}
+
+// RemoveSnapshot removes the named snapshot, optionally with its children.
+// As with RevertToSnapshot the most recent snapshot with the name is used.
+func (vm *VirtualMachine) RemoveSnapshot(ctx context.Context, name string, removeChildren bool) error {
+	snapshot, err := vm.findSnapshot(ctx, name)
+	if err != nil {
+		return err
+	}
+	debugf("vm.RemoveSnapshot(%s, %s)", vm.Name, name)
+	req := types.RemoveSnapshot_Task{
+		This:           snapshot.Ref,
+		RemoveChildren: removeChildren,
+	}
+	return vm.vs.withRetry(ctx, "RemoveSnapshot "+vm.Name, func() error {
+		res, err := methods.RemoveSnapshot_Task(ctx, vm.vs.client.Client, &req)
+		if err != nil {
+			return err
+		}
+		task := object.NewTask(vm.vs.client.Client, res.Returnval)
+		debugf("waiting for RemoveSnapshot %v", task)
+		return task.Wait(ctx)
+	})
+}
+
+// RevertToSnapshot reverts the VM to the named snapshot. Snapshot names aren't
+// unique, when several snapshots share the name the most recently created one
+// is used.
+func (vm *VirtualMachine) RevertToSnapshot(ctx context.Context, name string, suppressPowerOn bool) error {
+	snapshot, err := vm.findSnapshot(ctx, name)
+	if err != nil {
+		return err
+	}
+	debugf("vm.RevertToSnapshot(%s, %s)", vm.Name, name)
+	req := types.RevertToSnapshot_Task{
+		This:            snapshot.Ref,
+		SuppressPowerOn: types.NewBool(suppressPowerOn),
+	}
+	return vm.vs.withRetry(ctx, "RevertToSnapshot "+vm.Name, func() error {
+		res, err := methods.RevertToSnapshot_Task(ctx, vm.vs.client.Client, &req)
+		if err != nil {
+			return err
+		}
+		task := object.NewTask(vm.vs.client.Client, res.Returnval)
+		debugf("waiting for RevertToSnapshot %v", task)
+		return task.Wait(ctx)
+	})
+}
+
+// findSnapshot walks the VM's snapshot tree for snapshots with name,
+// returning the most recently created match
+func (vm *VirtualMachine) findSnapshot(ctx context.Context, name string) (*Snapshot, error) {
+	var mvm mo.VirtualMachine
+	if err := vm.mo.Properties(ctx, vm.mo.Reference(), []string{"snapshot"}, &mvm); err != nil {
+		return nil, err
+	}
+	if mvm.Snapshot == nil {
+		return nil, fmt.Errorf("vm %s has no snapshots", vm.Name)
+	}
+	var latest *types.VirtualMachineSnapshotTree
+	for _, tree := range walkSnapshots(mvm.Snapshot.RootSnapshotList, name) {
+		if latest == nil || tree.CreateTime.After(latest.CreateTime) {
+			latest = tree
+		}
+	}
+	if latest == nil {
+		return nil, fmt.Errorf("snapshot %q not found on vm %s", name, vm.Name)
+	}
+	return &Snapshot{Name: latest.Name, Ref: latest.Snapshot}, nil
+}
+
+func walkSnapshots(trees []types.VirtualMachineSnapshotTree, name string) []*types.VirtualMachineSnapshotTree {
+	var found []*types.VirtualMachineSnapshotTree
+	for i := range trees {
+		if trees[i].Name == name {
+			found = append(found, &trees[i])
+		}
+		found = append(found, walkSnapshots(trees[i].ChildSnapshotList, name)...)
+	}
+	return found
+}
@@ -0,0 +1,191 @@
+package vsphere
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// restClient is a minimal client for the vSphere Automation REST API, used
+// for tagging which isn't available over SOAP. It shares the SOAP client's
+// transport so TLS settings apply to both.
+type restClient struct {
+	base   *url.URL
+	user   *url.Userinfo
+	client *http.Client
+
+	mu        sync.Mutex
+	sessionID string
+}
+
+func newRESTClient(sdkURL *url.URL, client *http.Client) *restClient {
+	base := *sdkURL
+	base.User = nil
+	base.Path = "/rest"
+	return &restClient{
+		base:   &base,
+		user:   sdkURL.User,
+		client: &http.Client{Transport: client.Transport},
+	}
+}
+
+// login creates a REST session with the SOAP session's credentials, unless
+// one is already established
+func (r *restClient) login(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.sessionID != "" {
+		return nil
+	}
+	req, err := http.NewRequest("POST", r.url("/com/vmware/cis/session"), nil)
+	if err != nil {
+		return err
+	}
+	pass, _ := r.user.Password()
+	req.SetBasicAuth(r.user.Username(), pass)
+	var id string
+	if err := r.send(ctx, req, &id); err != nil {
+		return fmt.Errorf("rest login: %s", err)
+	}
+	r.sessionID = id
+	return nil
+}
+
+func (r *restClient) url(p string) string {
+	return r.base.String() + p
+}
+
+// do sends a request in the REST session, encoding body and decoding the
+// response's value into out when they are non-nil
+func (r *restClient) do(ctx context.Context, method, p string, body, out interface{}) error {
+	if err := r.login(ctx); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, r.url(p), &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	r.mu.Lock()
+	req.Header.Set("vmware-api-session-id", r.sessionID)
+	r.mu.Unlock()
+	return r.send(ctx, req, out)
+}
+
+func (r *restClient) send(ctx context.Context, req *http.Request, out interface{}) error {
+	req.Header.Set("Accept", "application/json")
+	res, err := r.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Path, res.Status, strings.TrimSpace(string(data)))
+	}
+	if out == nil {
+		return nil
+	}
+	var v struct {
+		Value json.RawMessage `json:"value"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	return json.Unmarshal(v.Value, out)
+}
+
+// parseTag splits a "category:tag" pair
+func parseTag(s string) (category, tag string, err error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("tag %q is not in category:tag form", s)
+	}
+	return parts[0], parts[1], nil
+}
+
+// findTag returns the id of the tag named tag in the category named category
+func (r *restClient) findTag(ctx context.Context, category, tag string) (string, error) {
+	var categoryIDs []string
+	if err := r.do(ctx, "GET", "/com/vmware/cis/tagging/category", nil, &categoryIDs); err != nil {
+		return "", err
+	}
+	for _, categoryID := range categoryIDs {
+		var c struct{ Name string }
+		if err := r.do(ctx, "GET", "/com/vmware/cis/tagging/category/id:"+url.PathEscape(categoryID), nil, &c); err != nil {
+			return "", err
+		}
+		if c.Name != category {
+			continue
+		}
+		var tagIDs []string
+		p := "/com/vmware/cis/tagging/tag/id:" + url.PathEscape(categoryID) + "?~action=list-tags-for-category"
+		if err := r.do(ctx, "POST", p, nil, &tagIDs); err != nil {
+			return "", err
+		}
+		for _, tagID := range tagIDs {
+			var t struct{ Name string }
+			if err := r.do(ctx, "GET", "/com/vmware/cis/tagging/tag/id:"+url.PathEscape(tagID), nil, &t); err != nil {
+				return "", err
+			}
+			if t.Name == tag {
+				return tagID, nil
+			}
+		}
+		return "", fmt.Errorf("tag %s not found in category %s", tag, category)
+	}
+	return "", fmt.Errorf("tag category %s not found", category)
+}
+
+// attachTag attaches the tag with id tagID to the managed object ref
+func (r *restClient) attachTag(ctx context.Context, tagID string, ref types.ManagedObjectReference) error {
+	body := map[string]interface{}{
+		"object_id": map[string]string{
+			"id":   ref.Value,
+			"type": ref.Type,
+		},
+	}
+	p := "/com/vmware/cis/tagging/tag-association/id:" + url.PathEscape(tagID) + "?~action=attach"
+	return r.do(ctx, "POST", p, body, nil)
+}
+
+// AttachTags attaches tags, given as category:tag pairs, to the VM
+func (vm *VirtualMachine) AttachTags(ctx context.Context, tags []string) error {
+	if vm.vs.rest == nil {
+		return errors.New("tagging requires a session with a user and password")
+	}
+	for _, s := range tags {
+		category, tag, err := parseTag(s)
+		if err != nil {
+			return err
+		}
+		debugf("rest.findTag(%s)", s)
+		tagID, err := vm.vs.rest.findTag(ctx, category, tag)
+		if err != nil {
+			return err
+		}
+		debugf("rest.attachTag(%s, %s)", s, vm.Name)
+		if err := vm.vs.rest.attachTag(ctx, tagID, vm.mo.Reference()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package vsphere
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// sessionToken is what SaveToken writes, the session cookie for a host
+type sessionToken struct {
+	Host    string         `json:"host"`
+	Cookies []*http.Cookie `json:"cookies"`
+}
+
+// SaveToken writes the session's cookie to w, for RestoreSession to reuse the
+// session later. The token grants access to vSphere so keep it secret.
+func (vs *Session) SaveToken(w io.Writer) error {
+	if vs.client == nil || vs.client.Client == nil || vs.client.Client.Client == nil {
+		return errors.New("session is not connected")
+	}
+	soapClient := vs.client.Client.Client
+	u := soapClient.URL()
+	return json.NewEncoder(w).Encode(sessionToken{
+		Host:    u.Host,
+		Cookies: soapClient.Jar.Cookies(u),
+	})
+}
+
+// RestoreSession creates a Session reusing the session saved by SaveToken to
+// r, logging in again if the saved session has expired or is for another host
+func RestoreSession(ctx context.Context, cp ConnectionParams, r io.Reader) (*Session, error) {
+	var token sessionToken
+	if err := json.NewDecoder(r).Decode(&token); err != nil {
+		return nil, err
+	}
+	var cookies []*http.Cookie
+	if token.Host == cp.Host {
+		cookies = token.Cookies
+	} else {
+		debugf("saved session is for %s, logging in to %s", token.Host, cp.Host)
+	}
+	sess := newSession(cp)
+	return sess, sess.connect(ctx, cp, cookies)
+}
@@ -0,0 +1,154 @@
+package vsphere
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/vmware/govmomi/vim25/progress"
+	"github.com/vmware/govmomi/vim25/soap"
+)
+
+// UploadToDatastore uploads r to remotePath on the named datastore, e.g. a
+// prepared VMDK for CreateVM to reference
+func (vs *Session) UploadToDatastore(ctx context.Context, datastoreName, remotePath string, r io.Reader) error {
+	return vs.UploadToDatastoreWithProgress(ctx, datastoreName, remotePath, r, readerSize(r), nil)
+}
+
+// UploadToDatastoreWithProgress is UploadToDatastore for size bytes, calling
+// progress with the completion percentage as the upload proceeds
+func (vs *Session) UploadToDatastoreWithProgress(ctx context.Context, datastoreName, remotePath string, r io.Reader, size int64, progressFn func(pct int)) error {
+	finder, err := vs.getFinder(ctx)
+	if err != nil {
+		return err
+	}
+	ds, err := vs.findDatastore(ctx, finder, datastoreName)
+	if err != nil {
+		return err
+	}
+
+	param := soap.DefaultUpload
+	if size > 0 {
+		param.ContentLength = size
+	}
+	var wait func()
+	if progressFn != nil {
+		param.Progress, wait = progressSink(progressFn)
+	}
+	debugf("datastore.Upload(%s) %d bytes", ds.Path(remotePath), size)
+	err = ds.Upload(ctx, &contextReader{ctx: ctx, r: r}, remotePath, &param)
+	if wait != nil {
+		wait()
+	}
+	if err != nil {
+		return err
+	}
+	debugf("uploaded %s", ds.Path(remotePath))
+	return nil
+}
+
+// DownloadFromDatastore downloads remotePath on the named datastore to w
+func (vs *Session) DownloadFromDatastore(ctx context.Context, datastoreName, remotePath string, w io.Writer) error {
+	return vs.DownloadFromDatastoreWithProgress(ctx, datastoreName, remotePath, w, nil)
+}
+
+// DownloadFromDatastoreWithProgress is DownloadFromDatastore, calling progress
+// with the completion percentage as the download proceeds
+func (vs *Session) DownloadFromDatastoreWithProgress(ctx context.Context, datastoreName, remotePath string, w io.Writer, progressFn func(pct int)) (err error) {
+	finder, err := vs.getFinder(ctx)
+	if err != nil {
+		return err
+	}
+	ds, err := vs.findDatastore(ctx, finder, datastoreName)
+	if err != nil {
+		return err
+	}
+
+	debugf("datastore.Download(%s)", ds.Path(remotePath))
+	param := soap.DefaultDownload
+	rc, size, err := ds.Download(ctx, remotePath, &param)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	var r io.Reader = &contextReader{ctx: ctx, r: rc}
+	if progressFn != nil {
+		sink, wait := progressSink(progressFn)
+		pr := progress.NewReader(sink, r, size)
+		r = pr
+		defer func() {
+			pr.Done(err)
+			wait()
+		}()
+	}
+	n, err := io.Copy(w, r)
+	if err != nil {
+		return err
+	}
+	debugf("downloaded %d bytes from %s", n, ds.Path(remotePath))
+	return nil
+}
+
+// readerSize returns the size of r if it can tell, otherwise zero
+func readerSize(r io.Reader) int64 {
+	switch v := r.(type) {
+	case interface{ Len() int }:
+		return int64(v.Len())
+	case interface{ Stat() (os.FileInfo, error) }:
+		if info, err := v.Stat(); err == nil {
+			return info.Size()
+		}
+	}
+	return 0
+}
+
+// contextReader stops reading once ctx is done, as datastore transfers
+// don't otherwise observe the context
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// progressSink adapts fn to a progress.Sinker, calling it when the whole
+// percentage changes. wait returns once the last report has been handled, or
+// straight away if the transfer never started.
+func progressSink(fn func(pct int)) (sink progress.Sinker, wait func()) {
+	var mu sync.Mutex
+	var done chan struct{}
+	sink = progress.SinkFunc(func() chan<- progress.Report {
+		ch := make(chan progress.Report)
+		mu.Lock()
+		done = make(chan struct{})
+		finished := done
+		mu.Unlock()
+		go func() {
+			defer close(finished)
+			last := -1
+			for report := range ch {
+				if pct := int(report.Percentage()); pct != last {
+					last = pct
+					fn(pct)
+				}
+			}
+		}()
+		return ch
+	})
+	wait = func() {
+		mu.Lock()
+		finished := done
+		mu.Unlock()
+		if finished != nil {
+			<-finished
+		}
+	}
+	return sink, wait
+}
@@ -0,0 +1,48 @@
+package vsphere
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"regexp"
+
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// UUID returns the VM's BIOS UUID, which the guest sees as its SMBIOS UUID
+func (vm *VirtualMachine) UUID(ctx context.Context) (string, error) {
+	var mvm mo.VirtualMachine
+	pc := property.DefaultCollector(vm.vs.client.Client)
+	err := pc.RetrieveOne(ctx, vm.mo.Reference(), []string{"config.uuid"}, &mvm)
+	if err != nil {
+		return "", err
+	}
+	if mvm.Config == nil {
+		return "", fmt.Errorf("vm %s has no config", vm.Name)
+	}
+	return mvm.Config.Uuid, nil
+}
+
+// SetUUID changes the VM's BIOS UUID, the VM must be powered off
+func (vm *VirtualMachine) SetUUID(ctx context.Context, uuid string) error {
+	if !uuidPattern.MatchString(uuid) {
+		return fmt.Errorf("invalid uuid %q", uuid)
+	}
+	debugf("setting %s uuid to %s", vm.Name, uuid)
+	return vm.Reconfigure(ctx, types.VirtualMachineConfigSpec{Uuid: uuid})
+}
+
+// RandomUUID returns a random version 4 UUID, e.g. for SetUUID
+func RandomUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
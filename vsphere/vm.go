@@ -1,6 +1,17 @@
 package vsphere
 
-import "github.com/vmware/govmomi/object"
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
 
 // VirtualMachine wraps govmomi's object.VirtualMachine
 type VirtualMachine struct {
@@ -8,66 +19,551 @@ type VirtualMachine struct {
 	mo *object.VirtualMachine
 
 	Name string
+
+	// VmkiteName is the guestinfo.vmkite-name of the VM, when listed with
+	// Session.ListVmkiteVMs
+	VmkiteName string
+
+	// VmkiteJobID is the guestinfo.vmkite-job-id of the VM, when listed with
+	// Session.ListVmkiteVMs
+	VmkiteJobID string
+
+	// PollInterval is how often guest state is checked when waiting on the
+	// guest, defaulting to two seconds
+	PollInterval time.Duration
+
+	// PowerOffOnShutdownTimeout makes ShutdownGuest hard power off the VM if
+	// the guest hasn't shut down in time
+	PowerOffOnShutdownTimeout bool
+
+	// Warnings are non-fatal errors from Session.CreateVM, such as failing
+	// to attach tags
+	Warnings []error
+}
+
+// InventoryPath returns the VM's inventory path, e.g. /dc/vm/folder/name. It's
+// known without a round trip for VMs looked up by path or created by vmkite,
+// otherwise it's built from the VM's ancestors and remembered.
+func (vm *VirtualMachine) InventoryPath(ctx context.Context) (string, error) {
+	if vm.mo.InventoryPath != "" {
+		return vm.mo.InventoryPath, nil
+	}
+	client := vm.vs.client.Client
+	debugf("mo.Ancestors(%s)", vm.Name)
+	entities, err := mo.Ancestors(ctx, client, client.ServiceContent.PropertyCollector, vm.mo.Reference())
+	if err != nil {
+		return "", err
+	}
+	if len(entities) == 0 {
+		return "", fmt.Errorf("no inventory path found for vm %s", vm.Name)
+	}
+	// the first entity is the root folder, which isn't part of the path
+	var names []string
+	for _, entity := range entities[1:] {
+		names = append(names, entity.Name)
+	}
+	p := "/" + path.Join(names...)
+	vm.mo.SetInventoryPath(p)
+	return p, nil
 }
 
-func (vm *VirtualMachine) Destroy(powerOff bool) error {
-	vs := vm.vs
+// VMStats is a VM's resource usage from its quick stats
+type VMStats struct {
+	CPUUsageMHz        int64
+	MemoryUsageMB      int64
+	GuestMemoryUsageMB int64
+	UptimeSeconds      int64
+}
 
-	if powerOff {
-		poweredOn, err := vm.IsPoweredOn()
-		if err != nil {
-			return err
+// Stats reads the VM's current CPU and memory usage and uptime
+func (vm *VirtualMachine) Stats(ctx context.Context) (VMStats, error) {
+	var mvm mo.VirtualMachine
+	pc := property.DefaultCollector(vm.vs.client.Client)
+	err := pc.RetrieveOne(ctx, vm.mo.Reference(), []string{"summary.quickStats"}, &mvm)
+	if err != nil {
+		return VMStats{}, err
+	}
+	qs := mvm.Summary.QuickStats
+	return VMStats{
+		CPUUsageMHz:        int64(qs.OverallCpuUsage),
+		MemoryUsageMB:      int64(qs.HostMemoryUsage),
+		GuestMemoryUsageMB: int64(qs.GuestMemoryUsage),
+		UptimeSeconds:      int64(qs.UptimeSeconds),
+	}, nil
+}
+
+// Destroy powers off the VM if needed and removes it along with its disks
+func (vm *VirtualMachine) Destroy(ctx context.Context) error {
+	return vm.DestroyWithDisks(ctx, true)
+}
+
+// DestroyWithDisks powers off the VM if needed and removes it, when
+// removeDisks is false the disks are detached first so their backing files
+// are left on the datastore
+func (vm *VirtualMachine) DestroyWithDisks(ctx context.Context, removeDisks bool) error {
+	poweredOn, err := vm.IsPoweredOn(ctx)
+	if err != nil {
+		return err
+	}
+	if poweredOn {
+		if err := vm.PowerOff(ctx); err != nil {
+			// the guest may have finished shutting down in the meantime
+			if poweredOn, stateErr := vm.IsPoweredOn(ctx); stateErr != nil || poweredOn {
+				return err
+			}
+			debugf("vm %s powered off during PowerOff, continuing", vm.Name)
 		}
-		if poweredOn {
-			vm.PowerOff()
+	}
+
+	if !removeDisks {
+		if err := vm.detachDisks(ctx); err != nil {
+			return err
 		}
 	}
 
 	debugf("vm.Destroy(%s)", vm.Name)
-	task, err := vm.mo.Destroy(vs.ctx)
+	err = vm.vs.withRetry(ctx, "Destroy "+vm.Name, func() error {
+		task, err := vm.mo.Destroy(ctx)
+		if err != nil {
+			return err
+		}
+		debugf("waiting for Destroy %v", task)
+		return task.Wait(ctx)
+	})
 	if err != nil {
 		return err
 	}
-	debugf("waiting for Destroy %v", task)
-	if err := task.Wait(vs.ctx); err != nil {
+	return nil
+}
+
+func (vm *VirtualMachine) detachDisks(ctx context.Context) error {
+	devices, err := vm.mo.Device(ctx)
+	if err != nil {
 		return err
 	}
-	return nil
+	disks := devices.SelectByType((*types.VirtualDisk)(nil))
+	if len(disks) == 0 {
+		return nil
+	}
+	debugf("vm.RemoveDevice(%s) detaching %d disks", vm.Name, len(disks))
+	return vm.mo.RemoveDevice(ctx, true, disks...)
 }
 
-func (vm *VirtualMachine) IsPoweredOn() (bool, error) {
-	vs := vm.vs
-	state, err := vm.mo.PowerState(vs.ctx)
+func (vm *VirtualMachine) IsPoweredOn(ctx context.Context) (bool, error) {
+	state, err := vm.PowerState(ctx)
 	if err != nil {
 		return false, err
 	}
-	return state == "poweredOn", nil
+	return state == types.VirtualMachinePowerStatePoweredOn, nil
+}
+
+// PowerState reads only runtime.powerState from the property collector,
+// avoiding a fetch of the full VM config
+func (vm *VirtualMachine) PowerState(ctx context.Context) (types.VirtualMachinePowerState, error) {
+	var mvm mo.VirtualMachine
+	pc := property.DefaultCollector(vm.vs.client.Client)
+	err := pc.RetrieveOne(ctx, vm.mo.Reference(), []string{"runtime.powerState"}, &mvm)
+	if err != nil {
+		return "", err
+	}
+	return mvm.Runtime.PowerState, nil
 }
 
-func (vm *VirtualMachine) PowerOff() error {
-	vs := vm.vs
-	debugf("wm.PowerOff(%s)", vm.Name)
-	task, err := vm.mo.PowerOff(vs.ctx)
+// WaitForPowerState waits until the VM is in the target power state,
+// returning ErrWaitTimeout if it isn't within timeout. Power state changes are
+// pushed by the property collector rather than polled.
+func (vm *VirtualMachine) WaitForPowerState(ctx context.Context, target types.VirtualMachinePowerState, timeout time.Duration) error {
+	debugf("vm.WaitForPowerState(%s, %s)", vm.Name, target)
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	pc := property.DefaultCollector(vm.vs.client.Client)
+	err := property.Wait(waitCtx, pc, vm.mo.Reference(), []string{"runtime.powerState"}, func(changes []types.PropertyChange) bool {
+		for _, c := range changes {
+			if c.Name == "runtime.powerState" && c.Op == types.PropertyChangeOpAssign && c.Val == target {
+				return true
+			}
+		}
+		return false
+	})
 	if err != nil {
+		if ctx.Err() == nil && waitCtx.Err() == context.DeadlineExceeded {
+			return ErrWaitTimeout
+		}
 		return err
 	}
-	debugf("waiting for PowerOff %v", task)
-	if err := task.Wait(vs.ctx); err != nil {
+	debugf("vm %s is %s", vm.Name, powerStateName(target))
+	return nil
+}
+
+// PowerStateName returns the power state as "on", "off" or "suspended"
+func (vm *VirtualMachine) PowerStateName(ctx context.Context) (string, types.VirtualMachinePowerState, error) {
+	state, err := vm.PowerState(ctx)
+	if err != nil {
+		return "", state, err
+	}
+	return powerStateName(state), state, nil
+}
+
+func powerStateName(state types.VirtualMachinePowerState) string {
+	switch state {
+	case types.VirtualMachinePowerStatePoweredOn:
+		return "on"
+	case types.VirtualMachinePowerStatePoweredOff:
+		return "off"
+	case types.VirtualMachinePowerStateSuspended:
+		return "suspended"
+	}
+	return string(state)
+}
+
+// PowerOff powers off the VM and waits for the task to complete
+func (vm *VirtualMachine) PowerOff(ctx context.Context) error {
+	debugf("vm.PowerOff(%s)", vm.Name)
+	err := vm.vs.withRetry(ctx, "PowerOff "+vm.Name, func() error {
+		task, err := vm.mo.PowerOff(ctx)
+		if err != nil {
+			return err
+		}
+		debugf("waiting for PowerOff %v", task)
+		return task.Wait(ctx)
+	})
+	if err != nil {
+		return err
+	}
+	debugf("vm %s powered off", vm.Name)
+	return nil
+}
+
+// ShutdownGuest asks the guest OS to shut down and waits until the VM is
+// powered off. If it doesn't power off within timeout ErrWaitTimeout is
+// returned, or the VM is hard powered off if PowerOffOnShutdownTimeout is set.
+// ErrToolsNotRunning is returned if VMware Tools isn't running in the guest.
+func (vm *VirtualMachine) ShutdownGuest(ctx context.Context, timeout time.Duration) error {
+	var mvm mo.VirtualMachine
+	pc := property.DefaultCollector(vm.vs.client.Client)
+	err := pc.RetrieveOne(ctx, vm.mo.Reference(), []string{"runtime.powerState", "guest.toolsRunningStatus"}, &mvm)
+	if err != nil {
+		return err
+	}
+	if mvm.Runtime.PowerState == types.VirtualMachinePowerStatePoweredOff {
+		debugf("vm %s already powered off", vm.Name)
+		return nil
+	}
+	if mvm.Guest == nil ||
+		mvm.Guest.ToolsRunningStatus != string(types.VirtualMachineToolsRunningStatusGuestToolsRunning) {
+		return ErrToolsNotRunning
+	}
+
+	debugf("vm.ShutdownGuest(%s)", vm.Name)
+	if err := vm.mo.ShutdownGuest(ctx); err != nil {
+		if isToolsUnavailable(err) {
+			return ErrToolsNotRunning
+		}
+		return err
+	}
+	err = vm.WaitForPowerState(ctx, types.VirtualMachinePowerStatePoweredOff, timeout)
+	if err == ErrWaitTimeout && vm.PowerOffOnShutdownTimeout {
+		warnf("vm %s didn't shut down within %v, powering off", vm.Name, timeout)
+		return vm.PowerOff(ctx)
+	} else if err != nil {
 		return err
 	}
+	debugf("vm %s shut down", vm.Name)
 	return nil
 }
 
-func (vm *VirtualMachine) PowerOn() error {
-	vs := vm.vs
+func isToolsUnavailable(err error) bool {
+	if soap.IsSoapFault(err) {
+		switch soap.ToSoapFault(err).VimFault().(type) {
+		case types.ToolsUnavailable:
+			return true
+		}
+	}
+	return false
+}
+
+// PowerOn powers on the VM and waits for the task to complete, resuming it if
+// it's suspended. It's a no-op if the VM is already powered on.
+func (vm *VirtualMachine) PowerOn(ctx context.Context) error {
+	poweredOn, err := vm.IsPoweredOn(ctx)
+	if err != nil {
+		return err
+	}
+	if poweredOn {
+		debugf("vm %s already powered on", vm.Name)
+		return nil
+	}
 	debugf("vm.PowerOn(%s)", vm.Name)
-	task, err := vm.mo.PowerOn(vs.ctx)
+	err = vm.vs.withRetry(ctx, "PowerOn "+vm.Name, func() error {
+		task, err := vm.mo.PowerOn(ctx)
+		if err != nil {
+			return err
+		}
+		debugf("waiting for PowerOn %v", task)
+		return task.Wait(ctx)
+	})
+	if err != nil {
+		return err
+	}
+	debugf("vm %s powered on", vm.Name)
+	return nil
+}
+
+// Suspend suspends the VM and waits for the task to complete, it's a no-op if
+// the VM is already suspended. PowerOn resumes it. Use WaitForPowerState to
+// wait for a suspend started elsewhere.
+func (vm *VirtualMachine) Suspend(ctx context.Context) error {
+	state, err := vm.PowerState(ctx)
+	if err != nil {
+		return err
+	}
+	if state == types.VirtualMachinePowerStateSuspended {
+		debugf("vm %s already suspended", vm.Name)
+		return nil
+	}
+	debugf("vm.Suspend(%s)", vm.Name)
+	err = vm.vs.withRetry(ctx, "Suspend "+vm.Name, func() error {
+		task, err := vm.mo.Suspend(ctx)
+		if err != nil {
+			return err
+		}
+		debugf("waiting for Suspend %v", task)
+		return task.Wait(ctx)
+	})
+	if err != nil {
+		return err
+	}
+	debugf("vm %s suspended", vm.Name)
+	return nil
+}
+
+// Reconfigure applies spec to the VM and waits for the task to complete.
+// Errors from vCenter, e.g. resizing a powered on VM without hot-add, are
+// returned as-is.
+func (vm *VirtualMachine) Reconfigure(ctx context.Context, spec types.VirtualMachineConfigSpec) error {
+	debugf("vm.Reconfigure(%s)", vm.Name)
+	return vm.vs.withRetry(ctx, "Reconfigure "+vm.Name, func() error {
+		task, err := vm.mo.Reconfigure(ctx, spec)
+		if err != nil {
+			return err
+		}
+		debugf("waiting for Reconfigure %v", task)
+		return task.Wait(ctx)
+	})
+}
+
+// Rename renames the VM in the inventory and updates Name. Only the
+// inventory name changes, the VM's folder and files on the datastore keep
+// the old name until the VM is migrated to another datastore.
+func (vm *VirtualMachine) Rename(ctx context.Context, newName string) error {
+	debugf("vm.Rename(%s, %s)", vm.Name, newName)
+	err := vm.vs.withRetry(ctx, "Rename "+vm.Name, func() error {
+		task, err := vm.mo.Rename(ctx, newName)
+		if err != nil {
+			return err
+		}
+		debugf("waiting for Rename %v", task)
+		return task.Wait(ctx)
+	})
+	if err != nil {
+		return err
+	}
+	if vm.mo.InventoryPath != "" {
+		vm.mo.SetInventoryPath(path.Join(path.Dir(vm.mo.InventoryPath), newName))
+	}
+	vm.Name = newName
+	return nil
+}
+
+// MoveToFolder moves the VM into the folder at folderPath, creating any
+// missing folders like EnsureFolder, and waits for the task to complete
+func (vm *VirtualMachine) MoveToFolder(ctx context.Context, folderPath string) error {
+	folder, err := vm.vs.EnsureFolder(ctx, folderPath)
+	if err != nil {
+		return err
+	}
+	debugf("folder.MoveInto(%s, %s)", folder.InventoryPath, vm.Name)
+	err = vm.vs.withRetry(ctx, "MoveIntoFolder "+vm.Name, func() error {
+		task, err := folder.MoveInto(ctx, []types.ManagedObjectReference{vm.mo.Reference()})
+		if err != nil {
+			return err
+		}
+		debugf("waiting for MoveIntoFolder %v", task)
+		return task.Wait(ctx)
+	})
 	if err != nil {
 		return err
 	}
-	debugf("waiting for PowerOn %v", task)
-	if err := task.Wait(vs.ctx); err != nil {
+	vm.mo.SetInventoryPath(path.Join(folder.InventoryPath, vm.Name))
+	return nil
+}
+
+// SetCPUs changes the number of virtual CPUs
+func (vm *VirtualMachine) SetCPUs(ctx context.Context, n int32) error {
+	debugf("setting %s cpus to %d", vm.Name, n)
+	return vm.Reconfigure(ctx, types.VirtualMachineConfigSpec{NumCPUs: n})
+}
+
+// SetMemoryMB changes the memory size
+func (vm *VirtualMachine) SetMemoryMB(ctx context.Context, mb int64) error {
+	debugf("setting %s memory to %dMB", vm.Name, mb)
+	return vm.Reconfigure(ctx, types.VirtualMachineConfigSpec{MemoryMB: mb})
+}
+
+// SetAnnotation replaces the VM's notes, an empty note clears them with
+// ClearAnnotation
+func (vm *VirtualMachine) SetAnnotation(ctx context.Context, note string) error {
+	if note == "" {
+		return vm.ClearAnnotation(ctx)
+	}
+	debugf("setting %s annotation to %q", vm.Name, note)
+	return vm.Reconfigure(ctx, types.VirtualMachineConfigSpec{Annotation: note})
+}
+
+// clearAnnotationBody is a ReconfigVM_Task request that always sends the
+// annotation, which types.VirtualMachineConfigSpec omits when it's empty
+type clearAnnotationBody struct {
+	Req    *clearAnnotationRequest        `xml:"urn:vim25 ReconfigVM_Task,omitempty"`
+	Res    *types.ReconfigVM_TaskResponse `xml:"urn:vim25 ReconfigVM_TaskResponse,omitempty"`
+	Fault_ *soap.Fault                    `xml:"http://schemas.xmlsoap.org/soap/envelope/ Fault,omitempty"`
+}
+
+func (b *clearAnnotationBody) Fault() *soap.Fault { return b.Fault_ }
+
+type clearAnnotationRequest struct {
+	This types.ManagedObjectReference `xml:"_this"`
+	Spec struct {
+		Annotation string `xml:"annotation"`
+	} `xml:"spec"`
+}
+
+// ClearAnnotation removes the VM's notes
+func (vm *VirtualMachine) ClearAnnotation(ctx context.Context) error {
+	debugf("clearing %s annotation", vm.Name)
+	return vm.vs.withRetry(ctx, "ClearAnnotation "+vm.Name, func() error {
+		body := clearAnnotationBody{
+			Req: &clearAnnotationRequest{This: vm.mo.Reference()},
+		}
+		if err := vm.vs.client.RoundTrip(ctx, &body, &body); err != nil {
+			return err
+		}
+		task := object.NewTask(vm.vs.client.Client, body.Res.Returnval)
+		debugf("waiting for ClearAnnotation %v", task)
+		return task.Wait(ctx)
+	})
+}
+
+// Migrate moves the VM to the host at targetHostPath, and the resource pool at
+// targetPoolPath if it's not empty, waiting for the task to complete. The
+// target host must be in the same cluster as the VM's current host.
+func (vm *VirtualMachine) Migrate(ctx context.Context, targetHostPath, targetPoolPath string) error {
+	finder, err := vm.vs.getFinder(ctx)
+	if err != nil {
+		return err
+	}
+	debugf("finder.HostSystem(%s)", targetHostPath)
+	host, err := finder.HostSystem(ctx, targetHostPath)
+	if err != nil {
+		return wrapNotFound(err, ErrHostNotFound, targetHostPath)
+	}
+
+	var mvm mo.VirtualMachine
+	pc := property.DefaultCollector(vm.vs.client.Client)
+	if err := pc.RetrieveOne(ctx, vm.mo.Reference(), []string{"runtime.host"}, &mvm); err != nil {
+		return err
+	}
+	if mvm.Runtime.Host == nil {
+		return fmt.Errorf("vm %s has no current host", vm.Name)
+	}
+	var current, target mo.HostSystem
+	if err := pc.RetrieveOne(ctx, *mvm.Runtime.Host, []string{"parent"}, &current); err != nil {
+		return err
+	}
+	if err := pc.RetrieveOne(ctx, host.Reference(), []string{"parent"}, &target); err != nil {
+		return err
+	}
+	if current.Parent == nil || target.Parent == nil || *current.Parent != *target.Parent ||
+		current.Parent.Type != "ClusterComputeResource" {
+		return fmt.Errorf("host %s is not in the same cluster as vm %s", targetHostPath, vm.Name)
+	}
+
+	hostRef := host.Reference()
+	spec := types.VirtualMachineRelocateSpec{Host: &hostRef}
+	if targetPoolPath != "" {
+		cluster := object.NewClusterComputeResource(vm.vs.client.Client, *target.Parent)
+		pool, err := vm.vs.resolveResourcePool(ctx, finder, cluster, targetPoolPath)
+		if err != nil {
+			return err
+		}
+		poolRef := pool.Reference()
+		spec.Pool = &poolRef
+	}
+
+	debugf("vm.Relocate(%s) to %s", vm.Name, targetHostPath)
+	err = vm.vs.withRetry(ctx, "Relocate "+vm.Name, func() error {
+		task, err := vm.mo.Relocate(ctx, spec, types.VirtualMachineMovePriorityDefaultPriority)
+		if err != nil {
+			return err
+		}
+		debugf("waiting for Relocate %v", task)
+		return task.Wait(ctx)
+	})
+	if err != nil {
+		return err
+	}
+	debugf("vm %s migrated to %s", vm.Name, targetHostPath)
+	return nil
+}
+
+// RelocateStorage moves the VM's files and disks to the datastore named
+// targetDatastore, waiting for the task to complete. Independent
+// nonpersistent disks, like the shared source disk, are left where they are
+// and only their redo logs move with the VM's files.
+func (vm *VirtualMachine) RelocateStorage(ctx context.Context, targetDatastore string) error {
+	finder, err := vm.vs.getFinder(ctx)
+	if err != nil {
+		return err
+	}
+	ds, err := vm.vs.findDatastore(ctx, finder, targetDatastore)
+	if err != nil {
+		return err
+	}
+	devices, err := vm.mo.Device(ctx)
+	if err != nil {
+		return err
+	}
+
+	dsRef := ds.Reference()
+	spec := types.VirtualMachineRelocateSpec{Datastore: &dsRef}
+	for _, device := range devices.SelectByType((*types.VirtualDisk)(nil)) {
+		disk := device.(*types.VirtualDisk)
+		backing, ok := disk.Backing.(*types.VirtualDiskFlatVer2BackingInfo)
+		if !ok || backing.DiskMode != string(types.VirtualDiskModeIndependent_nonpersistent) {
+			continue
+		}
+		if backing.Datastore == nil {
+			return fmt.Errorf("disk %s of vm %s has no datastore", backing.FileName, vm.Name)
+		}
+		debugf("leaving nonpersistent disk %s in place", backing.FileName)
+		spec.Disk = append(spec.Disk, types.VirtualMachineRelocateSpecDiskLocator{
+			DiskId:    disk.Key,
+			Datastore: *backing.Datastore,
+		})
+	}
+
+	debugf("vm.Relocate(%s) to datastore %s", vm.Name, targetDatastore)
+	err = vm.vs.withRetry(ctx, "Relocate "+vm.Name, func() error {
+		task, err := vm.mo.Relocate(ctx, spec, types.VirtualMachineMovePriorityDefaultPriority)
+		if err != nil {
+			return err
+		}
+		debugf("waiting for Relocate %v", task)
+		return task.Wait(ctx)
+	})
+	if err != nil {
 		return err
 	}
+	debugf("vm %s relocated to datastore %s", vm.Name, targetDatastore)
 	return nil
 }
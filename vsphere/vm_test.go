@@ -0,0 +1,69 @@
+package vsphere
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+	"github.com/vmware/govmomi/vim25/xml"
+)
+
+func TestSetAnnotation(t *testing.T) {
+	f := newFakeVC(t)
+	ref := f.addVM(f.vmFolder, "vmkite-1", nil)
+	vs := f.session()
+	vm := &VirtualMachine{vs: vs, mo: object.NewVirtualMachine(vs.client.Client, ref), Name: "vmkite-1"}
+	ctx := context.Background()
+
+	if err := vm.SetAnnotation(ctx, "built by vmkite"); err != nil {
+		t.Fatal(err)
+	}
+	if note := f.objects[ref].props["config.annotation"]; note != "built by vmkite" {
+		t.Errorf("annotation is %q, want %q", note, "built by vmkite")
+	}
+
+	if err := vm.SetAnnotation(ctx, ""); err != nil {
+		t.Fatal(err)
+	}
+	if note := f.objects[ref].props["config.annotation"]; note != "" {
+		t.Errorf("annotation is %q after clearing it", note)
+	}
+}
+
+func TestClearAnnotationSendsEmptyAnnotation(t *testing.T) {
+	body := clearAnnotationBody{Req: &clearAnnotationRequest{}}
+	out, err := xml.Marshal(&body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "ReconfigVM_Task") ||
+		!strings.Contains(string(out), "<annotation></annotation>") {
+		t.Errorf("request %s doesn't send an empty annotation", out)
+	}
+}
+
+func TestRenameRetriesTransientFault(t *testing.T) {
+	f := newFakeVC(t)
+	ref := f.addVM(f.vmFolder, "vmkite-1", nil)
+	vs := f.session()
+	vs.retry = RetryPolicy{MaxRetries: 1, MinBackoff: time.Millisecond}
+	vm := &VirtualMachine{vs: vs, mo: object.NewVirtualMachine(vs.client.Client, ref), Name: "vmkite-1"}
+
+	fault := &soap.Fault{Code: "ServerFaultCode", String: "vCenter is busy"}
+	fault.Detail.Fault = types.SystemError{}
+	f.fail("Rename_Task", soap.WrapSoapFault(fault))
+
+	if err := vm.Rename(context.Background(), "vmkite-2"); err != nil {
+		t.Fatal(err)
+	}
+	if n := f.count("Rename_Task"); n != 2 {
+		t.Errorf("Rename_Task called %d times, want 2", n)
+	}
+	if vm.Name != "vmkite-2" {
+		t.Errorf("vm is named %s, want vmkite-2", vm.Name)
+	}
+}
@@ -5,77 +5,368 @@ package vsphere
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"net/url"
+	"path"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/vmware/govmomi"
 	"github.com/vmware/govmomi/find"
 	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
 	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/task"
 	"github.com/vmware/govmomi/vim25"
 	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
 	"github.com/vmware/govmomi/vim25/soap"
 	"github.com/vmware/govmomi/vim25/types"
 )
 
 const keepAliveDuration = time.Second * 30
 
+const (
+	defaultDialTimeout         = time.Second * 30
+	defaultTLSHandshakeTimeout = time.Second * 30
+	tcpKeepAlive               = time.Second * 30
+)
+
+const defaultEthernetCardType = "vmxnet3"
+
+// bootDiskUnitNumber is the controller unit the source disk is attached at
+const bootDiskUnitNumber = 0
+
+// disk controller types, and the minimum hardware version needed for each
+const (
+	controllerTypeSCSI = "scsi"
+	controllerTypeSATA = "sata"
+	controllerTypeNVMe = "nvme"
+)
+
+var controllerMinHardwareVersion = map[string]int{
+	controllerTypeSATA: 10,
+	controllerTypeNVMe: 13,
+}
+
+// fallbackAPIVersion is used when the server's API version can't be detected
+const fallbackAPIVersion = "6.0"
+
 // ConnectionParams is passed by calling code to NewSession()
 type ConnectionParams struct {
 	Host     string
 	User     string
 	Pass     string
 	Insecure bool
+
+	// APIVersion pins the vSphere API version, by default the highest version
+	// supported by both vmkite and the server is negotiated
+	APIVersion string
+
+	// Datacenter is the name or inventory path of the datacenter to use,
+	// defaulting to the only datacenter
+	Datacenter string
+
+	// KeepAliveInterval is how often the session is kept alive, defaulting
+	// to 30 seconds
+	KeepAliveInterval time.Duration
+
+	// AutoReconnect logs in again and retries once when a call fails because
+	// the session has expired
+	AutoReconnect bool
+
+	// CACertPEM and CACertPath are CA certificates the server's certificate
+	// is verified against instead of the system roots, CACertPath may list
+	// several files. They're ignored if Insecure is set.
+	CACertPEM  []byte
+	CACertPath string
+
+	// ClientCertPEM and ClientKeyPEM are a client certificate and its key
+	// presented to the server for mutual TLS
+	ClientCertPEM []byte
+	ClientKeyPEM  []byte
+
+	// RequireAllowInsecure refuses to connect with Insecure set unless
+	// AllowInsecure is set too, so verification can't be turned off by
+	// accident
+	RequireAllowInsecure bool
+	AllowInsecure        bool
+
+	// DialTimeout and TLSHandshakeTimeout bound how long connecting to the
+	// server may take, each defaulting to 30 seconds
+	DialTimeout         time.Duration
+	TLSHandshakeTimeout time.Duration
+
+	// Retry is how task operations failing with a transient fault, like a
+	// busy vCenter, are retried. It covers every operation that runs a
+	// vCenter task, resubmitting the task. The zero value doesn't retry.
+	Retry RetryPolicy
+
+	// CacheTTL is how long datastore, network, cluster and resource pool
+	// lookups are cached, zero caches them until ClearCache is called
+	CacheTTL time.Duration
 }
 
 // Session holds state for a vSphere session;
-// client connection, context, session-cached values
+// client connection, session-cached values
 type Session struct {
-	client     *govmomi.Client
-	ctx        context.Context
-	datacenter *object.Datacenter
-	finder     *find.Finder
+	client           *govmomi.Client
+	datacenter       *object.Datacenter
+	datacenterPath   string
+	minDatastoreFree int64
+	finder           *find.Finder
+	login            func(context.Context) error
+	autoReconnect    bool
+	retry            RetryPolicy
+	rest             *restClient
+	pbm              *pbmClient
+	cache            lookupCache
 }
 
 // VirtualMachineCreationParams is passed by calling code to Session.CreateVM()
 type VirtualMachineCreationParams struct {
 	BuildkiteAgentToken string
 	ClusterPath         string
+	HostPath            string
+	FolderPath          string
+	ResourcePoolPath    string
 	VirtualMachinePath  string
 	DatastoreName       string
 	GuestID             string
 	MemoryMB            int64
 	Name                string
 	NetworkLabel        string
+	NetworkLabels       []string
+	MACAddress          string
+	EthernetCardType    string
 	NumCPUs             int32
 	NumCoresPerSocket   int32
+	CPUReservationMHz   *int64
+	CPULimitMHz         *int64
+	MemoryReservationMB *int64
+	MemoryLimitMB       *int64
+	CPUHotAddEnabled    *bool
+	MemoryHotAddEnabled *bool
 	SrcDiskDataStore    string
 	SrcDiskPath         string
+	DiskSizeGB          int64
+	DiskMode            string
+	ThinProvisioned     *bool
+	ControllerType      string
+	AdditionalDisks     []DiskSpec
+	ISODatastorePath    string
+	SerialPortURI       string
+	NestedHV            *bool
+	VirtualSMC          *bool
+	VirtualICH7M        *bool
+	HardwareVersion     string
+	Annotation          string
+	Firmware            string
+	SecureBoot          *bool
+	BootOrder           []string
+	BootDelayMS         int64
 	GuestInfo           map[string]string
+	BuildkiteJobID      string
+	BuildkitePipeline   string
+
+	// AdjustCoresPerSocket lowers NumCoresPerSocket to the nearest divisor of
+	// NumCPUs with a warning, rather than failing when it doesn't divide
+	// evenly. vCenter would otherwise pick its own topology.
+	AdjustCoresPerSocket bool
+
+	// NameCollisionRetries is how many times CreateVM retries with a numeric
+	// suffix, e.g. name-2, when a VM named Name already exists. The name
+	// used is the returned VirtualMachine's Name.
+	NameCollisionRetries int
+
+	// CopyDisk copies the source disk to DatastoreName and attaches the copy
+	// persistently rather than sharing the source disk. The copy is deleted
+	// with the VM by Destroy.
+	CopyDisk bool
+
+	// Tags are category:tag pairs attached to the VM once it is created.
+	// Failing to attach them doesn't fail the creation, see
+	// VirtualMachine.Warnings
+	Tags []string
+
+	// CustomAttributes are vCenter custom attributes set on the VM once it
+	// is created, adding missing fields. Failures are reported in
+	// VirtualMachine.Warnings
+	CustomAttributes map[string]string
+
+	// RawExtraConfig is added to the VM's extraConfig without a guestinfo.
+	// prefix, taking precedence over generated keys like the pci slots
+	RawExtraConfig map[string]string
+
+	// StoragePolicyName is the name of a storage policy, e.g. for vSAN,
+	// attached to the VM and its disks
+	StoragePolicyName string
+}
+
+// networkLabels returns NetworkLabel followed by NetworkLabels, one per NIC
+func (p VirtualMachineCreationParams) networkLabels() []string {
+	if p.NetworkLabel == "" {
+		return p.NetworkLabels
+	}
+	return append([]string{p.NetworkLabel}, p.NetworkLabels...)
+}
+
+// Validate checks the required fields are set and the sizes are sane, without
+// any api calls. CreateVM and ValidateCreateVM call it first.
+func (p VirtualMachineCreationParams) Validate() error {
+	required := []struct {
+		field, value string
+	}{
+		{"Name", p.Name},
+		{"ClusterPath", p.ClusterPath},
+		{"DatastoreName", p.DatastoreName},
+		{"SrcDiskDataStore", p.SrcDiskDataStore},
+		{"SrcDiskPath", p.SrcDiskPath},
+	}
+	for _, r := range required {
+		if r.value == "" {
+			return fmt.Errorf("%s is required", r.field)
+		}
+	}
+	if p.MemoryMB <= 0 {
+		return fmt.Errorf("invalid memory size %dMB, must be positive", p.MemoryMB)
+	}
+	if p.NumCPUs <= 0 {
+		return fmt.Errorf("invalid number of cpus %d, must be positive", p.NumCPUs)
+	}
+	if p.NumCoresPerSocket < 0 {
+		return fmt.Errorf("invalid cores per socket %d, can't be negative", p.NumCoresPerSocket)
+	}
+	if p.NumCoresPerSocket > 0 && p.NumCPUs%p.NumCoresPerSocket != 0 && !p.AdjustCoresPerSocket {
+		return fmt.Errorf("%d cpus can't be split into sockets of %d cores", p.NumCPUs, p.NumCoresPerSocket)
+	}
+	if p.DiskSizeGB < 0 {
+		return fmt.Errorf("invalid disk size %dGB, can't be negative", p.DiskSizeGB)
+	}
+	return nil
+}
+
+// DiskSpec describes an empty data disk to create alongside the source disk
+type DiskSpec struct {
+	DatastoreName   string
+	SizeGB          int64
+	ThinProvisioned bool
+
+	// EagerlyScrub zeroes a thick disk when it's created, it can't be
+	// combined with ThinProvisioned
+	EagerlyScrub *bool
+}
+
+// CloneParams is passed by calling code to Session.CloneVM()
+type CloneParams struct {
+	SourcePath    string
+	Name          string
+	ClusterPath   string
+	DatastoreName string
+	LinkedClone   bool
+
+	// Hostname, if set, has vCenter set the clone's hostname with a guest
+	// customization spec, in Domain which defaults to local. All NICs are
+	// configured for DHCP. Customization needs VMware Tools and a Linux
+	// guest, vCenter can't customize macOS guests and the clone fails.
+	Hostname string
+	Domain   string
+
+	// NewUUID gives the clone a random BIOS UUID instead of the source's,
+	// so software keyed off the SMBIOS UUID can tell clones apart
+	NewUUID bool
 }
 
 // NewSession logs in to a new Session based on ConnectionParams
 func NewSession(ctx context.Context, cp ConnectionParams) (*Session, error) {
-	sess := &Session{
-		ctx: ctx,
+	sess := newSession(cp)
+	return sess, sess.connect(ctx, cp, nil)
+}
+
+// newSession returns a Session with the settings from cp, before connecting
+func newSession(cp ConnectionParams) *Session {
+	return &Session{
+		autoReconnect:  cp.AutoReconnect,
+		retry:          cp.Retry,
+		datacenterPath: cp.Datacenter,
+		cache:          lookupCache{ttl: cp.CacheTTL},
 	}
-	return sess, sess.connect(ctx, cp)
+}
+
+// NewSessionFromClient creates a Session reusing an already logged in govmomi
+// client, avoiding a second login to vCenter. Of cp only Retry, CacheTTL,
+// AutoReconnect, Datacenter and User and Pass are used. Without User and
+// Pass the session can't log in again for AutoReconnect or to the REST api
+// for tags. Keep-alives, and retrying 503 responses, need a session created
+// with NewSession.
+func NewSessionFromClient(ctx context.Context, client *govmomi.Client, cp ConnectionParams) (*Session, error) {
+	if client == nil || !client.Client.Valid() {
+		return nil, errors.New("client is not connected")
+	}
+	userSession, err := client.SessionManager.UserSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if userSession == nil {
+		return nil, errors.New("client is not logged in")
+	}
+	debugf("reusing session of %s", userSession.UserName)
+
+	sess := newSession(cp)
+	sess.client = client
+	soapClient := client.Client.Client
+	sess.pbm = newPBMClient(soapClient)
+	if cp.User != "" {
+		u := soapClient.URL()
+		u.User = url.UserPassword(cp.User, cp.Pass)
+		sess.login = func(ctx context.Context) error {
+			return client.Login(ctx, u.User)
+		}
+		sess.rest = newRESTClient(u, &soapClient.Client)
+	}
+	return sess, nil
 }
 
 // Connect to vSphere API, with keep-alive
 // See https://github.com/vmware/vic/blob/master/pkg/vsphere/session/session.go#L191
-func (s *Session) connect(ctx context.Context, cp ConnectionParams) error {
+//
+// If cookies are given they're tried as an existing session before logging in
+func (s *Session) connect(ctx context.Context, cp ConnectionParams, cookies []*http.Cookie) error {
 	u, err := url.Parse(fmt.Sprintf("https://%s/sdk", cp.Host))
 	if err != nil {
 		return err
 	}
 
+	if cp.Insecure {
+		if cp.RequireAllowInsecure && !cp.AllowInsecure {
+			return errors.New("insecure connections are not allowed without AllowInsecure")
+		}
+		warnf("TLS certificate verification of %s is disabled, the connection is open to interception", cp.Host)
+	}
+
 	u.User = url.UserPassword(cp.User, cp.Pass)
 	soapClient := soap.NewClient(u, cp.Insecure)
-	soapClient.Version = "6.0" // Pin to 6.0 until we need 6.5+ specific API
+	if err := setRootCAs(soapClient, cp); err != nil {
+		return err
+	}
+	if err := setClientCertificate(soapClient, cp); err != nil {
+		return err
+	}
+	if err := setTimeouts(soapClient, cp); err != nil {
+		return err
+	}
+	soapClient.Client.Transport = unavailableTransport{soapClient.Client.Transport}
+	soapClient.Version = fallbackAPIVersion
+	if cp.APIVersion != "" {
+		soapClient.Version = cp.APIVersion
+	}
 
 	var login = func(ctx context.Context) error {
 		return s.client.Login(ctx, u.User)
@@ -86,17 +377,27 @@ func (s *Session) connect(ctx context.Context, cp ConnectionParams) error {
 		return err
 	}
 
-	vimClient.RoundTripper = session.KeepAliveHandler(soapClient, keepAliveDuration,
+	if cp.APIVersion == "" {
+		soapClient.Version = negotiateAPIVersion(vimClient.ServiceContent.About.ApiVersion)
+	}
+	debugf("using vSphere API version %s", soapClient.Version)
+
+	keepAlive := cp.KeepAliveInterval
+	if keepAlive <= 0 {
+		keepAlive = keepAliveDuration
+	}
+
+	vimClient.RoundTripper = session.KeepAliveHandler(soapClient, keepAlive,
 		func(roundTripper soap.RoundTripper) error {
 			_, err := methods.GetCurrentTime(context.Background(), roundTripper)
 			if err == nil {
 				return nil
 			}
 
-			debugf("session keepalive error: %s", err)
+			warnf("session keepalive error: %s", err)
 			if isNotAuthenticated(err) {
 				if err = login(ctx); err != nil {
-					debugf("session keepalive failed to re-authenticate: %s", err)
+					warnf("session keepalive failed to re-authenticate: %s", err)
 				} else {
 					debugf("session keepalive re-authenticated")
 				}
@@ -109,90 +410,905 @@ func (s *Session) connect(ctx context.Context, cp ConnectionParams) error {
 		Client:         vimClient,
 		SessionManager: session.NewManager(vimClient),
 	}
-
-	return login(ctx)
+
+	s.login = login
+	s.rest = newRESTClient(u, &soapClient.Client)
+	s.pbm = newPBMClient(soapClient)
+
+	if len(cookies) > 0 {
+		soapClient.Jar.SetCookies(soapClient.URL(), cookies)
+		userSession, err := s.client.SessionManager.UserSession(ctx)
+		if err == nil && userSession != nil {
+			debugf("reusing saved session of %s", userSession.UserName)
+			return nil
+		}
+		debugf("saved session is no longer valid, logging in")
+	}
+
+	return login(ctx)
+}
+
+// setRootCAs configures the client to verify the server against the CA
+// certificates in cp, if any
+func setRootCAs(soapClient *soap.Client, cp ConnectionParams) error {
+	if len(cp.CACertPEM) == 0 && cp.CACertPath == "" {
+		return nil
+	}
+	if cp.Insecure {
+		warnf("ignoring CA certificates as certificate verification is disabled")
+		return nil
+	}
+	if cp.CACertPath != "" {
+		debugf("loading CA certificates from %s", cp.CACertPath)
+		if err := soapClient.SetRootCAs(cp.CACertPath); err != nil {
+			return err
+		}
+	}
+	if len(cp.CACertPEM) > 0 {
+		config, err := tlsConfig(soapClient)
+		if err != nil {
+			return err
+		}
+		pool := config.RootCAs
+		if pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(cp.CACertPEM) {
+			return errors.New("no CA certificates found in PEM")
+		}
+		config.RootCAs = pool
+	}
+	return nil
+}
+
+// setClientCertificate configures the client to present the client
+// certificate in cp, if any, during the TLS handshake
+func setClientCertificate(soapClient *soap.Client, cp ConnectionParams) error {
+	if len(cp.ClientCertPEM) == 0 && len(cp.ClientKeyPEM) == 0 {
+		return nil
+	}
+	cert, err := tls.X509KeyPair(cp.ClientCertPEM, cp.ClientKeyPEM)
+	if err != nil {
+		return fmt.Errorf("loading client certificate: %s", err)
+	}
+	config, err := tlsConfig(soapClient)
+	if err != nil {
+		return err
+	}
+	debugf("using client certificate")
+	config.Certificates = []tls.Certificate{cert}
+	return nil
+}
+
+// setTimeouts bounds the client's dial and TLS handshake, and enables TCP
+// keep-alives so a dead connection to the server is noticed
+func setTimeouts(soapClient *soap.Client, cp ConnectionParams) error {
+	transport, ok := soapClient.Client.Transport.(*http.Transport)
+	if !ok {
+		return errors.New("can't configure timeouts on the client's transport")
+	}
+	dialTimeout := cp.DialTimeout
+	if dialTimeout <= 0 {
+		dialTimeout = defaultDialTimeout
+	}
+	handshakeTimeout := cp.TLSHandshakeTimeout
+	if handshakeTimeout <= 0 {
+		handshakeTimeout = defaultTLSHandshakeTimeout
+	}
+	dialer := &net.Dialer{
+		Timeout:   dialTimeout,
+		KeepAlive: tcpKeepAlive,
+	}
+	transport.DialContext = dialer.DialContext
+	transport.TLSHandshakeTimeout = handshakeTimeout
+	// soap's DialTLS handshakes without any timeout, and only adds
+	// thumbprint verification which vmkite doesn't use, so let the
+	// transport do the handshake itself
+	transport.DialTLS = nil
+	return nil
+}
+
+// tlsConfig returns the TLS config of the client's transport
+func tlsConfig(soapClient *soap.Client) (*tls.Config, error) {
+	transport, ok := soapClient.Client.Transport.(*http.Transport)
+	if !ok || transport.TLSClientConfig == nil {
+		return nil, errors.New("can't configure TLS on the client's transport")
+	}
+	return transport.TLSClientConfig, nil
+}
+
+// Ping checks the session is still alive with the same cheap call the
+// keep-alive makes, returning an error if vCenter can't be reached or the
+// session is no longer authenticated
+func (vs *Session) Ping(ctx context.Context) error {
+	debugf("methods.GetCurrentTime()")
+	_, err := methods.GetCurrentTime(ctx, vs.client.Client)
+	return err
+}
+
+// withReauth calls fn, and if AutoReconnect is set and fn failed because the
+// session expired, logs in again and retries fn once
+func (vs *Session) withReauth(ctx context.Context, fn func() error) error {
+	err := fn()
+	if err == nil || !vs.autoReconnect || vs.login == nil || !isNotAuthenticated(err) {
+		return err
+	}
+	debugf("session not authenticated, logging in again")
+	if err := vs.login(ctx); err != nil {
+		return err
+	}
+	return fn()
+}
+
+// negotiateAPIVersion picks the lower of the server's API version and the
+// newest version the vendored vim25 bindings support
+func negotiateAPIVersion(serverVersion string) string {
+	server, ok := parseAPIVersion(serverVersion)
+	if !ok {
+		debugf("unable to detect API version from %q, falling back to %s", serverVersion, fallbackAPIVersion)
+		return fallbackAPIVersion
+	}
+	supported, _ := parseAPIVersion(soap.DefaultVimVersion)
+	for i := 0; i < len(server) && i < len(supported); i++ {
+		if server[i] != supported[i] {
+			if server[i] > supported[i] {
+				return soap.DefaultVimVersion
+			}
+			return serverVersion
+		}
+	}
+	if len(server) > len(supported) {
+		return soap.DefaultVimVersion
+	}
+	return serverVersion
+}
+
+func parseAPIVersion(v string) ([]int, bool) {
+	if v == "" {
+		return nil, false
+	}
+	parts := strings.Split(v, ".")
+	nums := make([]int, len(parts))
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, false
+		}
+		nums[i] = n
+	}
+	return nums, true
+}
+
+func (vs *Session) VirtualMachine(ctx context.Context, path string) (vm *VirtualMachine, err error) {
+	err = vs.withReauth(ctx, func() error {
+		vm, err = vs.virtualMachine(ctx, path)
+		return err
+	})
+	return
+}
+
+// VMExists returns whether there's a VM at path, only returning an error when
+// the lookup itself fails
+func (vs *Session) VMExists(ctx context.Context, path string) (bool, error) {
+	_, err := vs.VirtualMachine(ctx, path)
+	if errors.Is(err, ErrVirtualMachineNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (vs *Session) virtualMachine(ctx context.Context, path string) (*VirtualMachine, error) {
+	finder, err := vs.getFinder(ctx)
+	if err != nil {
+		return nil, err
+	}
+	debugf("finder.VirtualMachine(%v)", path)
+	vm, err := finder.VirtualMachine(ctx, path)
+	if err != nil {
+		return nil, wrapNotFound(err, ErrVirtualMachineNotFound, path)
+	}
+	return &VirtualMachine{
+		vs:   vs,
+		mo:   vm,
+		Name: vm.Name(),
+	}, nil
+}
+
+// ListVirtualMachines lists the VMs in folderPath, defaulting to the
+// datacenter's VM folder
+func (vs *Session) ListVirtualMachines(ctx context.Context, folderPath string) (vms []*VirtualMachine, err error) {
+	err = vs.withReauth(ctx, func() error {
+		vms, err = vs.listVirtualMachines(ctx, folderPath)
+		return err
+	})
+	return
+}
+
+func (vs *Session) listVirtualMachines(ctx context.Context, folderPath string) ([]*VirtualMachine, error) {
+	finder, err := vs.getFinder(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if folderPath == "" {
+		folder, err := vs.vmFolder(ctx)
+		if err != nil {
+			return nil, err
+		}
+		folderPath = folder.InventoryPath
+	}
+	debugf("finder.VirtualMachineList(%s/*)", folderPath)
+	mos, err := finder.VirtualMachineList(ctx, folderPath+"/*")
+	if _, ok := err.(*find.NotFoundError); ok {
+		return []*VirtualMachine{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// fetch all the names in one round trip
+	refs := make([]types.ManagedObjectReference, len(mos))
+	for i, vm := range mos {
+		refs[i] = vm.Reference()
+	}
+	var mvms []mo.VirtualMachine
+	pc := property.DefaultCollector(vs.client.Client)
+	if err := pc.Retrieve(ctx, refs, []string{"name"}, &mvms); err != nil {
+		return nil, err
+	}
+	names := make(map[types.ManagedObjectReference]string, len(mvms))
+	for _, mvm := range mvms {
+		names[mvm.Reference()] = mvm.Name
+	}
+
+	vms := make([]*VirtualMachine, len(mos))
+	for i, vm := range mos {
+		vms[i] = &VirtualMachine{
+			vs:   vs,
+			mo:   vm,
+			Name: names[vm.Reference()],
+		}
+	}
+	return vms, nil
+}
+
+// ListVmkiteVMs lists the VMs in the datacenter's VM folder and its
+// subfolders that were created by vmkite, identified by their
+// guestinfo.vmkite-name
+func (vs *Session) ListVmkiteVMs(ctx context.Context) (vms []*VirtualMachine, err error) {
+	err = vs.withReauth(ctx, func() error {
+		vms, err = vs.listVmkiteVMs(ctx)
+		return err
+	})
+	return
+}
+
+func (vs *Session) listVmkiteVMs(ctx context.Context) ([]*VirtualMachine, error) {
+	if _, err := vs.getFinder(ctx); err != nil {
+		return nil, err
+	}
+	folder, err := vs.vmFolder(ctx)
+	if err != nil {
+		return nil, err
+	}
+	mvms, err := vs.retrieveVMsRecursive(ctx, folder, []string{"name", "config.extraConfig"})
+	if err != nil {
+		return nil, err
+	}
+
+	vmkiteVMs := []*VirtualMachine{}
+	for _, mvm := range mvms {
+		if mvm.Config == nil {
+			continue
+		}
+		vm := &VirtualMachine{
+			vs:   vs,
+			mo:   object.NewVirtualMachine(vs.client.Client, mvm.Reference()),
+			Name: mvm.Name,
+		}
+		isVmkite := false
+		for _, opt := range mvm.Config.ExtraConfig {
+			switch ov := opt.GetOptionValue(); ov.Key {
+			case "guestinfo.vmkite-name":
+				vm.VmkiteName = fmt.Sprint(ov.Value)
+				isVmkite = true
+			case "guestinfo.vmkite-job-id":
+				vm.VmkiteJobID = fmt.Sprint(ov.Value)
+			}
+		}
+		if isVmkite {
+			vmkiteVMs = append(vmkiteVMs, vm)
+		}
+	}
+	return vmkiteVMs, nil
+}
+
+// retrieveVMsRecursive retrieves props of every VM in folder and its
+// subfolders in one round trip, using a recursive container view
+func (vs *Session) retrieveVMsRecursive(ctx context.Context, folder *object.Folder, props []string) ([]mo.VirtualMachine, error) {
+	debugf("methods.CreateContainerView(%s)", folder.InventoryPath)
+	res, err := methods.CreateContainerView(ctx, vs.client.Client, &types.CreateContainerView{
+		This:      *vs.client.ServiceContent.ViewManager,
+		Container: folder.Reference(),
+		Type:      []string{"VirtualMachine"},
+		Recursive: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	view := res.Returnval
+	defer func() {
+		if _, err := methods.DestroyView(ctx, vs.client.Client, &types.DestroyView{This: view}); err != nil {
+			debugf("failed to destroy container view %s: %s", view, err)
+		}
+	}()
+
+	req := types.RetrieveProperties{
+		SpecSet: []types.PropertyFilterSpec{{
+			ObjectSet: []types.ObjectSpec{{
+				Obj:  view,
+				Skip: types.NewBool(true),
+				SelectSet: []types.BaseSelectionSpec{
+					&types.TraversalSpec{Type: "ContainerView", Path: "view"},
+				},
+			}},
+			PropSet: []types.PropertySpec{{Type: "VirtualMachine", PathSet: props}},
+		}},
+	}
+	pc := property.DefaultCollector(vs.client.Client)
+	rp, err := pc.RetrieveProperties(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	var mvms []mo.VirtualMachine
+	if err := mo.LoadRetrievePropertiesResponse(rp, &mvms); err != nil {
+		return nil, err
+	}
+	return mvms, nil
+}
+
+// FindVMByJobID returns the vmkite VM whose guestinfo.vmkite-job-id is jobID,
+// searching the VM folder and its subfolders like ListVmkiteVMs, with
+// ErrVirtualMachineNotFound if there's none, or an error if there are several
+func (vs *Session) FindVMByJobID(ctx context.Context, jobID string) (*VirtualMachine, error) {
+	if jobID == "" {
+		return nil, errors.New("job id is empty")
+	}
+	vms, err := vs.ListVmkiteVMs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var found []*VirtualMachine
+	for _, vm := range vms {
+		if vm.VmkiteJobID == jobID {
+			found = append(found, vm)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("%w: no vm for job %s", ErrVirtualMachineNotFound, jobID)
+	case 1:
+		return found[0], nil
+	}
+	names := make([]string, len(found))
+	for i, vm := range found {
+		names[i] = vm.Name
+	}
+	return nil, fmt.Errorf("job %s has %d vms: %s", jobID, len(found), strings.Join(names, ", "))
+}
+
+// CreateVM launches a new macOS VM based on VirtualMachineCreationParams
+func (vs *Session) CreateVM(ctx context.Context, params VirtualMachineCreationParams) (*VirtualMachine, error) {
+	return vs.createVM(ctx, params, nil)
+}
+
+// CreateVMWithProgress is CreateVM, calling progress with the completion
+// percentage and current phase as the creation task progresses
+func (vs *Session) CreateVMWithProgress(ctx context.Context, params VirtualMachineCreationParams, progress func(pct int, phase string)) (*VirtualMachine, error) {
+	return vs.createVM(ctx, params, progress)
+}
+
+// CreateVMIfNotExists returns the VM named params.Name in the VM's folder if
+// it already exists, otherwise it creates it like CreateVM
+func (vs *Session) CreateVMIfNotExists(ctx context.Context, params VirtualMachineCreationParams) (vm *VirtualMachine, err error) {
+	err = vs.withReauth(ctx, func() error {
+		vm, err = vs.existingVM(ctx, params)
+		return err
+	})
+	if err == nil {
+		debugf("vm %s already exists, skipping create", vm.Name)
+		return vm, nil
+	} else if !errors.Is(err, ErrVirtualMachineNotFound) {
+		return nil, err
+	}
+	return vs.CreateVM(ctx, params)
+}
+
+// existingVM looks up the VM CreateVM would create from params
+func (vs *Session) existingVM(ctx context.Context, params VirtualMachineCreationParams) (*VirtualMachine, error) {
+	if _, err := vs.getFinder(ctx); err != nil {
+		return nil, err
+	}
+	folderPath := params.FolderPath
+	if !strings.HasPrefix(folderPath, "/") {
+		folder, err := vs.vmFolder(ctx)
+		if err != nil {
+			return nil, err
+		}
+		folderPath = path.Join(folder.InventoryPath, folderPath)
+	}
+	return vs.virtualMachine(ctx, path.Join(folderPath, params.Name))
+}
+
+// createVM creates the VM, logging in again if the session expired only
+// around the steps that are safe to repeat, so a VM is never created twice
+func (vs *Session) createVM(ctx context.Context, params VirtualMachineCreationParams, progress func(pct int, phase string)) (vm *VirtualMachine, err error) {
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if isManagedObjectNotFound(err) {
+			debugf("cached lookup may be stale: %s", err)
+			vs.ClearCache()
+		}
+	}()
+	var p *vmPlacement
+	err = vs.withReauth(ctx, func() error {
+		finder, err := vs.getFinder(ctx)
+		if err != nil {
+			return err
+		}
+		p, err = vs.prepareCreateVM(ctx, finder, params)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if params.CopyDisk {
+		if params, err = vs.copySourceDisk(ctx, params); err != nil {
+			return nil, err
+		}
+		err = vs.withReauth(ctx, func() (err error) {
+			p.configSpec, err = vs.createConfigSpec(ctx, params)
+			return err
+		})
+		if err != nil {
+			vs.deleteCopiedDisk(ctx, params)
+			return nil, err
+		}
+	}
+	vm, err = vs.createVMInFolder(ctx, params, p, progress)
+	if err != nil && params.CopyDisk {
+		vs.deleteCopiedDisk(ctx, params)
+	}
+	return vm, err
+}
+
+// createVMInFolder creates the VM prepared by prepareCreateVM in its folder
+// and applies the post-create settings
+func (vs *Session) createVMInFolder(ctx context.Context, params VirtualMachineCreationParams, p *vmPlacement, progress func(pct int, phase string)) (*VirtualMachine, error) {
+	var folder *object.Folder
+	err := vs.withReauth(ctx, func() (err error) {
+		if params.FolderPath != "" {
+			folder, err = vs.EnsureFolder(ctx, params.FolderPath)
+		} else {
+			folder, err = vs.vmFolder(ctx)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	name := params.Name
+	for attempt := 1; ; attempt++ {
+		p.configSpec.Name = name
+		err := vs.withRetry(ctx, "CreateVM "+name, func() error {
+			return vs.createVMTask(ctx, folder, p, progress)
+		})
+		if err == nil {
+			break
+		}
+		if !isDuplicateName(err) || attempt > params.NameCollisionRetries {
+			return nil, err
+		}
+		name = fmt.Sprintf("%s-%d", params.Name, attempt+1)
+		debugf("vm name %s is taken, retrying as %s", params.Name, name)
+	}
+	var vm *VirtualMachine
+	err = vs.withReauth(ctx, func() (err error) {
+		vm, err = vs.virtualMachine(ctx, folder.InventoryPath+"/"+name)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(params.Tags) > 0 {
+		if err := vm.AttachTags(ctx, params.Tags); err != nil {
+			warnf("failed to tag vm %s: %s", vm.Name, err)
+			vm.Warnings = append(vm.Warnings, fmt.Errorf("tagging: %s", err))
+		}
+	}
+	if err := vm.SetCustomAttributes(ctx, params.CustomAttributes); err != nil {
+		warnf("failed to set custom attributes on vm %s: %s", vm.Name, err)
+		vm.Warnings = append(vm.Warnings, fmt.Errorf("custom attributes: %s", err))
+	}
+	return vm, nil
+}
+
+// createVMTask submits CreateVM_Task and waits for it to complete. Each is
+// retried after logging in again if the session expired: a rejected submit
+// creates nothing, and waiting on the same task again is harmless. Other
+// errors while waiting aren't retried by withRetry, as the VM may exist.
+func (vs *Session) createVMTask(ctx context.Context, folder *object.Folder, p *vmPlacement, progress func(pct int, phase string)) error {
+	var task *object.Task
+	err := vs.withReauth(ctx, func() (err error) {
+		debugf("folder.CreateVM %s on %s", p.configSpec.Name, p.resourcePool)
+		task, err = folder.CreateVM(ctx, p.configSpec, p.resourcePool, p.host)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	debugf("waiting for CreateVM %v", task)
+	return submittedTaskError(vs.withReauth(ctx, func() error {
+		return vs.waitForTask(ctx, task, progress)
+	}))
+}
+
+// ValidateCreateVM checks that everything params refers to exists, such as
+// the cluster, datastores and networks, and builds the VM's config without
+// creating anything. Folders in FolderPath are created by CreateVM so they
+// aren't required to exist.
+func (vs *Session) ValidateCreateVM(ctx context.Context, params VirtualMachineCreationParams) error {
+	if err := params.Validate(); err != nil {
+		return err
+	}
+	finder, err := vs.getFinder(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = vs.prepareCreateVM(ctx, finder, params)
+	return err
+}
+
+// vmPlacement is where and how CreateVM creates a VM
+type vmPlacement struct {
+	resourcePool *object.ResourcePool
+	host         *object.HostSystem
+	configSpec   types.VirtualMachineConfigSpec
+}
+
+// prepareCreateVM does the lookups and validation for creating a VM from
+// params, up to building its config spec
+func (vs *Session) prepareCreateVM(ctx context.Context, finder *find.Finder, params VirtualMachineCreationParams) (*vmPlacement, error) {
+	for _, tag := range params.Tags {
+		if _, _, err := parseTag(tag); err != nil {
+			return nil, err
+		}
+	}
+	cluster, err := vs.findCluster(ctx, finder, params.ClusterPath)
+	if err != nil {
+		return nil, err
+	}
+	resourcePool, err := vs.resolveResourcePool(ctx, finder, cluster, params.ResourcePoolPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := vs.checkGuestController(ctx, cluster, params); err != nil {
+		return nil, err
+	}
+	var host *object.HostSystem
+	if params.HostPath != "" {
+		debugf("finder.HostSystem(%s)", params.HostPath)
+		host, err = finder.HostSystem(ctx, params.HostPath)
+		if err != nil {
+			return nil, wrapNotFound(err, ErrHostNotFound, params.HostPath)
+		}
+	}
+	configSpec, err := vs.createConfigSpec(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	return &vmPlacement{
+		resourcePool: resourcePool,
+		host:         host,
+		configSpec:   configSpec,
+	}, nil
+}
+
+// resolveResourcePool finds the resource pool at poolPath, checking it
+// belongs to cluster, or the cluster's root pool if poolPath is empty
+func (vs *Session) resolveResourcePool(ctx context.Context, finder *find.Finder, cluster *object.ClusterComputeResource, poolPath string) (*object.ResourcePool, error) {
+	if poolPath == "" {
+		debugf("cluster.ResourcePool()")
+		return cluster.ResourcePool(ctx)
+	}
+	pool, err := vs.findResourcePool(ctx, finder, poolPath)
+	if err != nil {
+		return nil, err
+	}
+	var mpool mo.ResourcePool
+	if err := pool.Properties(ctx, pool.Reference(), []string{"owner"}, &mpool); err != nil {
+		return nil, err
+	}
+	if mpool.Owner != cluster.Reference() {
+		return nil, fmt.Errorf("resource pool %s does not belong to cluster %s",
+			poolPath, cluster.InventoryPath)
+	}
+	return pool, nil
+}
+
+// checkGuestController checks the guest OS supports the disk controller type,
+// using the cluster's guest OS descriptors for the hardware version
+func (vs *Session) checkGuestController(ctx context.Context, cluster *object.ClusterComputeResource, params VirtualMachineCreationParams) error {
+	var want string
+	switch params.ControllerType {
+	case controllerTypeSATA:
+		want = "VirtualAHCIController"
+	case controllerTypeNVMe:
+		want = "VirtualNVMEController"
+	default:
+		return nil
+	}
+	if params.GuestID == "" {
+		return nil
+	}
+	var mcluster mo.ClusterComputeResource
+	if err := cluster.Properties(ctx, cluster.Reference(), []string{"environmentBrowser"}, &mcluster); err != nil {
+		return err
+	}
+	if mcluster.EnvironmentBrowser == nil {
+		debugf("cluster has no environment browser, skipping controller check")
+		return nil
+	}
+	debugf("environmentBrowser.QueryConfigOption(%s)", params.HardwareVersion)
+	res, err := methods.QueryConfigOption(ctx, vs.client.Client, &types.QueryConfigOption{
+		This: *mcluster.EnvironmentBrowser,
+		Key:  params.HardwareVersion,
+	})
+	if err != nil {
+		return err
+	}
+	if res.Returnval == nil {
+		return nil
+	}
+	for _, guest := range res.Returnval.GuestOSDescriptor {
+		if guest.Id != params.GuestID {
+			continue
+		}
+		for _, controller := range guest.SupportedDiskControllerList {
+			if controller == want {
+				return nil
+			}
+		}
+		return fmt.Errorf("guest %s doesn't support %s controllers", params.GuestID, params.ControllerType)
+	}
+	debugf("no guest os descriptor for %s, skipping controller check", params.GuestID)
+	return nil
 }
 
-func (vs *Session) VirtualMachine(path string) (*VirtualMachine, error) {
-	finder, err := vs.getFinder()
-	if err != nil {
-		return nil, err
+// waitForTask waits for task to complete, calling progress if it's not nil on
+// each update of the task's info
+func (vs *Session) waitForTask(ctx context.Context, t *object.Task, progress func(pct int, phase string)) error {
+	if progress == nil {
+		return t.Wait(ctx)
 	}
-	debugf("finder.VirtualMachine(%v)", path)
-	vm, err := finder.VirtualMachine(vs.ctx, path)
+	var taskErr error
+	pc := property.DefaultCollector(vs.client.Client)
+	err := property.Wait(ctx, pc, t.Reference(), []string{"info"}, func(changes []types.PropertyChange) bool {
+		for _, c := range changes {
+			if c.Name != "info" || c.Op != types.PropertyChangeOpAssign || c.Val == nil {
+				continue
+			}
+			info := c.Val.(types.TaskInfo)
+			phase := info.DescriptionId
+			if info.Description != nil && info.Description.Message != "" {
+				phase = info.Description.Message
+			}
+			switch info.State {
+			case types.TaskInfoStateSuccess:
+				progress(100, phase)
+				return true
+			case types.TaskInfoStateError:
+				taskErr = fmt.Errorf("task %s failed", info.DescriptionId)
+				if info.Error != nil {
+					taskErr = task.Error{LocalizedMethodFault: info.Error}
+				}
+				return true
+			default:
+				progress(int(info.Progress), phase)
+			}
+		}
+		return false
+	})
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return &VirtualMachine{
-		vs:   vs,
-		mo:   vm,
-		Name: vm.Name(),
-	}, nil
+	return taskErr
 }
 
-// CreateVM launches a new macOS VM based on VirtualMachineCreationParams
-func (vs *Session) CreateVM(params VirtualMachineCreationParams) (*VirtualMachine, error) {
-	finder, err := vs.getFinder()
+// CloneVM clones a VM or template based on CloneParams
+func (vs *Session) CloneVM(ctx context.Context, params CloneParams) (*VirtualMachine, error) {
+	finder, err := vs.getFinder(ctx)
 	if err != nil {
 		return nil, err
 	}
-	folder, err := vs.vmFolder()
+	folder, err := vs.vmFolder(ctx)
 	if err != nil {
 		return nil, err
 	}
-	debugf("finder.ClusterComputeResource(%s)", params.ClusterPath)
-	cluster, err := finder.ClusterComputeResource(vs.ctx, params.ClusterPath)
+	debugf("finder.VirtualMachine(%s)", params.SourcePath)
+	src, err := finder.VirtualMachine(ctx, params.SourcePath)
+	if err != nil {
+		return nil, wrapNotFound(err, ErrVirtualMachineNotFound, params.SourcePath)
+	}
+	cluster, err := vs.findCluster(ctx, finder, params.ClusterPath)
 	if err != nil {
 		return nil, err
 	}
 	debugf("cluster.ResourcePool()")
-	resourcePool, err := cluster.ResourcePool(vs.ctx)
+	resourcePool, err := cluster.ResourcePool(ctx)
 	if err != nil {
 		return nil, err
 	}
-	configSpec, err := vs.createConfigSpec(params)
+	poolRef := resourcePool.Reference()
+	spec := types.VirtualMachineCloneSpec{
+		Location: types.VirtualMachineRelocateSpec{
+			Pool: &poolRef,
+		},
+	}
+	if params.DatastoreName != "" {
+		ds, err := vs.findDatastore(ctx, finder, params.DatastoreName)
+		if err != nil {
+			return nil, err
+		}
+		dsRef := ds.Reference()
+		spec.Location.Datastore = &dsRef
+	}
+	if params.LinkedClone {
+		var mvm mo.VirtualMachine
+		if err := src.Properties(ctx, src.Reference(), []string{"snapshot"}, &mvm); err != nil {
+			return nil, err
+		}
+		if mvm.Snapshot == nil || mvm.Snapshot.CurrentSnapshot == nil {
+			return nil, fmt.Errorf(
+				"linked clone requires a snapshot, create a snapshot of %s first",
+				params.SourcePath)
+		}
+		debugf("linked clone from snapshot %v", mvm.Snapshot.CurrentSnapshot)
+		spec.Snapshot = mvm.Snapshot.CurrentSnapshot
+		spec.Location.DiskMoveType = string(types.VirtualMachineRelocateDiskMoveOptionsCreateNewChildDiskBacking)
+	}
+	if params.NewUUID {
+		uuid, err := RandomUUID()
+		if err != nil {
+			return nil, err
+		}
+		debugf("giving clone %s uuid %s", params.Name, uuid)
+		spec.Config = &types.VirtualMachineConfigSpec{Uuid: uuid}
+	}
+	if params.Hostname != "" {
+		customization, err := hostnameCustomization(ctx, src, params)
+		if err != nil {
+			return nil, err
+		}
+		spec.Customization = customization
+	}
+	debugf("src.Clone %s => %s on %s", params.SourcePath, params.Name, resourcePool)
+	err = vs.withRetry(ctx, "Clone "+params.Name, func() error {
+		task, err := src.Clone(ctx, folder, params.Name, spec)
+		if err != nil {
+			return err
+		}
+		debugf("waiting for Clone %v", task)
+		return submittedTaskError(task.Wait(ctx))
+	})
 	if err != nil {
 		return nil, err
 	}
-	debugf("folder.CreateVM %s on %s", params.Name, resourcePool)
-	task, err := folder.CreateVM(vs.ctx, configSpec, resourcePool, nil)
+	vm, err := vs.VirtualMachine(ctx, folder.InventoryPath+"/"+params.Name)
 	if err != nil {
 		return nil, err
 	}
-	debugf("waiting for CreateVM %v", task)
-	if err := task.Wait(vs.ctx); err != nil {
-		return nil, err
+	return vm, nil
+}
+
+// hostnameCustomization returns a customization spec setting the hostname of
+// a clone of src, keeping each of its NICs on DHCP
+func hostnameCustomization(ctx context.Context, src *object.VirtualMachine, params CloneParams) (*types.CustomizationSpec, error) {
+	if !validHostname(params.Hostname) {
+		return nil, fmt.Errorf("invalid hostname %q", params.Hostname)
+	}
+	domain := params.Domain
+	if domain == "" {
+		domain = "local"
 	}
-	vm, err := vs.VirtualMachine(folder.InventoryPath + "/" + params.Name)
+	devices, err := src.Device(ctx)
 	if err != nil {
 		return nil, err
 	}
-	return vm, nil
+	nics := devices.SelectByType((*types.VirtualEthernetCard)(nil))
+	nicSettings := make([]types.CustomizationAdapterMapping, len(nics))
+	for i := range nics {
+		nicSettings[i] = types.CustomizationAdapterMapping{
+			Adapter: types.CustomizationIPSettings{
+				Ip: &types.CustomizationDhcpIpGenerator{},
+			},
+		}
+	}
+	debugf("customizing hostname to %s.%s", params.Hostname, domain)
+	return &types.CustomizationSpec{
+		Identity: &types.CustomizationLinuxPrep{
+			HostName: &types.CustomizationFixedName{Name: params.Hostname},
+			Domain:   domain,
+		},
+		NicSettingMap: nicSettings,
+	}, nil
+}
+
+// validHostname checks name is a single RFC 1123 label
+func validHostname(name string) bool {
+	if len(name) == 0 || len(name) > 63 || name[0] == '-' || name[len(name)-1] == '-' {
+		return false
+	}
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-':
+		default:
+			return false
+		}
+	}
+	return true
 }
 
-func (vs *Session) vmFolder() (*object.Folder, error) {
+func (vs *Session) vmFolder(ctx context.Context) (*object.Folder, error) {
 	if vs.datacenter == nil {
 		return nil, errors.New("datacenter not loaded")
 	}
-	dcFolders, err := vs.datacenter.Folders(vs.ctx)
+	dcFolders, err := vs.datacenter.Folders(ctx)
 	if err != nil {
 		return nil, err
 	}
 	return dcFolders.VmFolder, nil
 }
 
-func (vs *Session) createConfigSpec(params VirtualMachineCreationParams) (cs types.VirtualMachineConfigSpec, err error) {
-	devices, err := addEthernet(nil, vs, params.NetworkLabel)
+func (vs *Session) createConfigSpec(ctx context.Context, params VirtualMachineCreationParams) (cs types.VirtualMachineConfigSpec, err error) {
+	if params.HardwareVersion != "" && !strings.HasPrefix(params.HardwareVersion, "vmx-") {
+		err = fmt.Errorf("invalid hardware version %q, expected e.g. vmx-13", params.HardwareVersion)
+		return
+	}
+
+	switch types.GuestOsDescriptorFirmwareType(params.Firmware) {
+	case "", types.GuestOsDescriptorFirmwareTypeBios, types.GuestOsDescriptorFirmwareTypeEfi:
+	default:
+		err = fmt.Errorf("invalid firmware %q, must be bios or efi", params.Firmware)
+		return
+	}
+	if params.SecureBoot != nil && *params.SecureBoot &&
+		params.Firmware != string(types.GuestOsDescriptorFirmwareTypeEfi) {
+		err = errors.New("secure boot requires efi firmware")
+		return
+	}
+	if err = validateControllerType(params.ControllerType, params.HardwareVersion); err != nil {
+		return
+	}
+
+	devices, err := addEthernet(ctx, nil, vs, params)
+	if err != nil {
+		return
+	}
+
+	devices, err = addDiskController(devices, params.ControllerType)
 	if err != nil {
 		return
 	}
 
-	devices, err = addSCSI(devices)
+	devices, err = addDisk(ctx, devices, vs, params)
 	if err != nil {
 		return
 	}
 
-	devices, err = addDisk(devices, vs, params)
+	dataDisks, err := createDataDisks(ctx, devices, vs, params.ControllerType, params.AdditionalDisks)
 	if err != nil {
 		return
 	}
@@ -202,16 +1318,43 @@ func (vs *Session) createConfigSpec(params VirtualMachineCreationParams) (cs typ
 		return
 	}
 
+	devices, err = addCDROM(devices, params.ISODatastorePath)
+	if err != nil {
+		return
+	}
+
+	devices, err = addSerial(devices, params.SerialPortURI)
+	if err != nil {
+		return
+	}
+
 	deviceChange, err := devices.ConfigSpec(types.VirtualDeviceConfigSpecOperationAdd)
 	if err != nil {
 		return
 	}
 
+	dataDiskChange, err := dataDisks.ConfigSpec(types.VirtualDeviceConfigSpecOperationAdd)
+	if err != nil {
+		return
+	}
+	for _, change := range dataDiskChange {
+		change.GetVirtualDeviceConfigSpec().FileOperation = types.VirtualDeviceConfigSpecFileOperationCreate
+	}
+	deviceChange = append(deviceChange, dataDiskChange...)
+
 	extraConfig := []types.BaseOptionValue{
 		&types.OptionValue{Key: "guestinfo.vmkite-buildkite-agent-token", Value: params.BuildkiteAgentToken},
 		&types.OptionValue{Key: "guestinfo.vmkite-name", Value: params.Name},
 		&types.OptionValue{Key: "guestinfo.vmkite-vmdk", Value: params.SrcDiskPath},
 	}
+	if params.BuildkiteJobID != "" {
+		extraConfig = append(extraConfig,
+			&types.OptionValue{Key: "guestinfo.vmkite-job-id", Value: params.BuildkiteJobID})
+	}
+	if params.BuildkitePipeline != "" {
+		extraConfig = append(extraConfig,
+			&types.OptionValue{Key: "guestinfo.vmkite-pipeline", Value: params.BuildkitePipeline})
+	}
 
 	if params.GuestInfo != nil {
 		for key, val := range params.GuestInfo {
@@ -222,17 +1365,21 @@ func (vs *Session) createConfigSpec(params VirtualMachineCreationParams) (cs typ
 		}
 	}
 
-	// ensure a consistent pci slot for the ethernet card, helps systemd
-	extraConfig = append(extraConfig,
-		&types.OptionValue{Key: "ethernet0.pciSlotNumber", Value: "32"},
-	)
+	// ensure a consistent pci slot for each ethernet card, helps systemd
+	for i := range params.networkLabels() {
+		extraConfig = append(extraConfig, &types.OptionValue{
+			Key:   fmt.Sprintf("ethernet%d.pciSlotNumber", i),
+			Value: strconv.Itoa(32 + i),
+		})
+	}
+
+	extraConfig = mergeRawExtraConfig(extraConfig, params.RawExtraConfig)
 
-	finder, err := vs.getFinder()
+	finder, err := vs.getFinder(ctx)
 	if err != nil {
 		return
 	}
-	debugf("finder.Datastore(%s)", params.DatastoreName)
-	ds, err := finder.Datastore(vs.ctx, params.DatastoreName)
+	ds, err := vs.findDatastore(ctx, finder, params.DatastoreName)
 	if err != nil {
 		return
 	}
@@ -240,70 +1387,324 @@ func (vs *Session) createConfigSpec(params VirtualMachineCreationParams) (cs typ
 		VmPathName: fmt.Sprintf("[%s]", ds.Name()),
 	}
 
-	t := true
+	boot, err := bootOptions(params, devices)
+	if err != nil {
+		return
+	}
+
 	cs = types.VirtualMachineConfigSpec{
+		Annotation:          params.Annotation,
 		DeviceChange:        deviceChange,
 		ExtraConfig:         extraConfig,
 		Files:               fileInfo,
 		GuestId:             params.GuestID,
 		MemoryMB:            params.MemoryMB,
 		Name:                params.Name,
-		NestedHVEnabled:     &t,
+		NestedHVEnabled:     boolOrTrue(params.NestedHV),
 		NumCPUs:             params.NumCPUs,
-		NumCoresPerSocket:   params.NumCoresPerSocket,
-		VirtualICH7MPresent: &t,
-		VirtualSMCPresent:   &t,
+		NumCoresPerSocket:   coresPerSocket(params),
+		VirtualICH7MPresent: boolOrTrue(params.VirtualICH7M),
+		VirtualSMCPresent:   boolOrTrue(params.VirtualSMC),
+		Version:             params.HardwareVersion,
+		CpuAllocation:       allocationInfo(params.CPUReservationMHz, params.CPULimitMHz),
+		MemoryAllocation:    allocationInfo(params.MemoryReservationMB, params.MemoryLimitMB),
+		CpuHotAddEnabled:    params.CPUHotAddEnabled,
+		MemoryHotAddEnabled: params.MemoryHotAddEnabled,
+		Firmware:            params.Firmware,
+		BootOptions:         boot,
+	}
+
+	if params.StoragePolicyName != "" {
+		err = vs.applyStoragePolicy(ctx, &cs, params.StoragePolicyName)
 	}
 
 	return
 }
 
-func addEthernet(devices object.VirtualDeviceList, vs *Session, label string) (object.VirtualDeviceList, error) {
-	finder, err := vs.getFinder()
-	if err != nil {
+// mergeRawExtraConfig adds raw settings to extraConfig verbatim, a raw key
+// that collides with a generated one replaces the generated value
+func mergeRawExtraConfig(extraConfig []types.BaseOptionValue, raw map[string]string) []types.BaseOptionValue {
+	for key, val := range raw {
+		replaced := false
+		for _, opt := range extraConfig {
+			if ov := opt.GetOptionValue(); ov.Key == key {
+				debugf("overriding %s=%q with %q", key, ov.Value, val)
+				ov.Value = val
+				replaced = true
+			}
+		}
+		if !replaced {
+			debugf("setting %s=%q", key, val)
+			extraConfig = append(extraConfig, &types.OptionValue{Key: key, Value: val})
+		}
+	}
+	return extraConfig
+}
+
+// bootOptions returns the boot options for params, or nil if none are set.
+// BootOrder entries are disk, net, cdrom or floppy, with disk and net booting
+// from the first disk and ethernet card in devices.
+func bootOptions(params VirtualMachineCreationParams, devices object.VirtualDeviceList) (*types.VirtualMachineBootOptions, error) {
+	if params.SecureBoot == nil && len(params.BootOrder) == 0 && params.BootDelayMS == 0 {
+		return nil, nil
+	}
+	options := &types.VirtualMachineBootOptions{
+		EfiSecureBootEnabled: params.SecureBoot,
+		BootDelay:            params.BootDelayMS,
+	}
+	for _, name := range params.BootOrder {
+		switch name {
+		case "disk":
+			disks := devices.SelectByType((*types.VirtualDisk)(nil))
+			if len(disks) == 0 {
+				return nil, errors.New("boot order includes disk but the vm has no disk")
+			}
+			options.BootOrder = append(options.BootOrder, &types.VirtualMachineBootOptionsBootableDiskDevice{
+				DeviceKey: disks[0].GetVirtualDevice().Key,
+			})
+		case "net":
+			nics := devices.SelectByType((*types.VirtualEthernetCard)(nil))
+			if len(nics) == 0 {
+				return nil, errors.New("boot order includes net but the vm has no ethernet card")
+			}
+			options.BootOrder = append(options.BootOrder, &types.VirtualMachineBootOptionsBootableEthernetDevice{
+				DeviceKey: nics[0].GetVirtualDevice().Key,
+			})
+		case "cdrom":
+			options.BootOrder = append(options.BootOrder, &types.VirtualMachineBootOptionsBootableCdromDevice{})
+		case "floppy":
+			options.BootOrder = append(options.BootOrder, &types.VirtualMachineBootOptionsBootableFloppyDevice{})
+		default:
+			return nil, fmt.Errorf("invalid boot device %q, must be disk, net, cdrom or floppy", name)
+		}
+	}
+	return options, nil
+}
+
+// allocationInfo returns a resource allocation, or nil if neither the
+// reservation nor limit is set
+func allocationInfo(reservation, limit *int64) *types.ResourceAllocationInfo {
+	if reservation == nil && limit == nil {
+		return nil
+	}
+	info := &types.ResourceAllocationInfo{}
+	if reservation != nil {
+		info.Reservation = *reservation
+	}
+	if limit != nil {
+		info.Limit = *limit
+	}
+	return info
+}
+
+// coresPerSocket returns NumCoresPerSocket, lowered to the nearest divisor
+// of NumCPUs if AdjustCoresPerSocket is set
+func coresPerSocket(params VirtualMachineCreationParams) int32 {
+	cores := params.NumCoresPerSocket
+	if !params.AdjustCoresPerSocket || cores <= 0 || params.NumCPUs <= 0 {
+		return cores
+	}
+	for params.NumCPUs%cores != 0 {
+		cores--
+	}
+	if cores != params.NumCoresPerSocket {
+		warnf("%d cpus can't be split into sockets of %d cores, using %d cores per socket",
+			params.NumCPUs, params.NumCoresPerSocket, cores)
+	}
+	return cores
+}
+
+// boolOrTrue defaults an unset *bool to true, as needed for macOS guests
+func boolOrTrue(b *bool) *bool {
+	if b == nil {
+		return types.NewBool(true)
+	}
+	return b
+}
+
+func addEthernet(ctx context.Context, devices object.VirtualDeviceList, vs *Session, params VirtualMachineCreationParams) (object.VirtualDeviceList, error) {
+	cardType := params.EthernetCardType
+	if cardType == "" {
+		cardType = defaultEthernetCardType
+	}
+	if err := validateEthernetCardType(cardType); err != nil {
 		return nil, err
 	}
-	path := "*" + label
-	debugf("finder.Network(%s)", path)
-	network, err := finder.Network(vs.ctx, path)
+	if params.MACAddress != "" {
+		if err := validateMACAddress(params.MACAddress); err != nil {
+			return nil, err
+		}
+	}
+	finder, err := vs.getFinder(ctx)
 	if err != nil {
 		return nil, err
 	}
-	backing, err := network.EthernetCardBackingInfo(vs.ctx)
+	for i, label := range params.networkLabels() {
+		network, err := vs.findNetwork(ctx, finder, label)
+		if err != nil {
+			return nil, err
+		}
+		backing, err := network.EthernetCardBackingInfo(ctx)
+		if err != nil {
+			return nil, err
+		}
+		device, err := object.EthernetCardTypes().CreateEthernetCard(cardType, backing)
+		if err != nil {
+			return nil, err
+		}
+		card := device.(types.BaseVirtualEthernetCard).GetVirtualEthernetCard()
+		card.Key = devices.NewKey()
+		card.AddressType = string(types.VirtualEthernetCardMacTypeGenerated)
+		if i == 0 && params.MACAddress != "" {
+			debugf("setting static mac address %s", params.MACAddress)
+			card.AddressType = string(types.VirtualEthernetCardMacTypeManual)
+			card.MacAddress = params.MACAddress
+		}
+		devices = append(devices, device)
+	}
+
+	return devices, nil
+}
+
+// findNetwork resolves a network label to a standard network or distributed
+// virtual port group, the latter having a DVS port backing rather than a
+// network backing. Distributed switches matching the label are ignored, and
+// a label matching more than one network or port group is an error.
+func findNetwork(ctx context.Context, finder *find.Finder, label string) (object.NetworkReference, error) {
+	path := "*" + label
+	debugf("finder.NetworkList(%s)", path)
+	networks, err := finder.NetworkList(ctx, path)
 	if err != nil {
-		return nil, err
+		return nil, wrapNotFound(err, ErrNetworkNotFound, label)
 	}
-	device, err := object.EthernetCardTypes().CreateEthernetCard("vmxnet3", backing)
+	var found []object.NetworkReference
+	for _, network := range networks {
+		if _, ok := network.(*object.DistributedVirtualSwitch); ok {
+			continue
+		}
+		found = append(found, network)
+	}
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("%w: %s", ErrNetworkNotFound, label)
+	case 1:
+		return found[0], nil
+	}
+	return nil, fmt.Errorf("network %s resolves to %d networks", label, len(found))
+}
+
+// validateEthernetCardType checks cardType is one of object.EthernetCardTypes()
+func validateEthernetCardType(cardType string) error {
+	ctypes := object.EthernetCardTypes()
+	valid := make([]string, len(ctypes))
+	for i, device := range ctypes {
+		valid[i] = strings.ToLower(strings.TrimPrefix(ctypes.TypeName(device), "Virtual"))
+		if valid[i] == cardType {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid ethernet card type %q, must be one of %s",
+		cardType, strings.Join(valid, ", "))
+}
+
+// validateMACAddress checks mac is a unicast address in the range vCenter
+// accepts for manually assigned addresses, 00:50:56:00:00:00-00:50:56:3f:ff:ff
+func validateMACAddress(mac string) error {
+	hw, err := net.ParseMAC(mac)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	card := device.(types.BaseVirtualEthernetCard).GetVirtualEthernetCard()
-	card.AddressType = string(types.VirtualEthernetCardMacTypeGenerated)
+	if len(hw) != 6 {
+		return fmt.Errorf("mac address %s is not a 48-bit address", mac)
+	}
+	if hw[0]&1 == 1 {
+		return fmt.Errorf("mac address %s is not unicast", mac)
+	}
+	if hw[0] != 0x00 || hw[1] != 0x50 || hw[2] != 0x56 || hw[3] > 0x3f {
+		return fmt.Errorf("mac address %s is outside the VMware static range 00:50:56:00:00:00-00:50:56:3f:ff:ff", mac)
+	}
+	return nil
+}
 
-	return append(devices, device), nil
+// validateControllerType checks the disk controller type is known and is
+// supported by the hardware version, if one is set
+func validateControllerType(controllerType, hardwareVersion string) error {
+	switch controllerType {
+	case "", controllerTypeSCSI, controllerTypeSATA, controllerTypeNVMe:
+	default:
+		return fmt.Errorf("invalid controller type %q, must be scsi, sata or nvme", controllerType)
+	}
+	minVersion, ok := controllerMinHardwareVersion[controllerType]
+	if !ok || hardwareVersion == "" {
+		return nil
+	}
+	version, err := strconv.Atoi(strings.TrimPrefix(hardwareVersion, "vmx-"))
+	if err != nil {
+		return fmt.Errorf("invalid hardware version %q, expected e.g. vmx-13", hardwareVersion)
+	}
+	if version < minVersion {
+		return fmt.Errorf("%s controllers need hardware version vmx-%d or later, got %s",
+			controllerType, minVersion, hardwareVersion)
+	}
+	return nil
 }
 
-func addSCSI(devices object.VirtualDeviceList) (object.VirtualDeviceList, error) {
-	scsi, err := object.SCSIControllerTypes().CreateSCSIController("scsi")
+// addDiskController adds a disk controller of controllerType, defaulting to
+// scsi
+func addDiskController(devices object.VirtualDeviceList, controllerType string) (object.VirtualDeviceList, error) {
+	var controller types.BaseVirtualDevice
+	var err error
+	switch controllerType {
+	case "", controllerTypeSCSI:
+		controller, err = object.SCSIControllerTypes().CreateSCSIController("scsi")
+	case controllerTypeSATA:
+		controller = &types.VirtualAHCIController{
+			VirtualSATAController: types.VirtualSATAController{
+				VirtualController: types.VirtualController{
+					VirtualDevice: types.VirtualDevice{Key: devices.NewKey()},
+				},
+			},
+		}
+	case controllerTypeNVMe:
+		controller, err = devices.CreateNVMEController()
+	default:
+		err = fmt.Errorf("invalid controller type %q, must be scsi, sata or nvme", controllerType)
+	}
 	if err != nil {
 		return nil, err
 	}
-	return append(devices, scsi), nil
+	return append(devices, controller), nil
+}
+
+// findDiskController returns the controller of controllerType disks are
+// attached to
+func findDiskController(devices object.VirtualDeviceList, controllerType string) (types.BaseVirtualController, error) {
+	switch controllerType {
+	case controllerTypeSATA:
+		controller := devices.PickController((*types.VirtualAHCIController)(nil))
+		if controller == nil {
+			return nil, errors.New("no available sata controller")
+		}
+		return controller, nil
+	case controllerTypeNVMe:
+		return devices.FindDiskController("nvme")
+	default:
+		return devices.FindDiskController("scsi")
+	}
 }
 
-func addDisk(devices object.VirtualDeviceList, vs *Session, params VirtualMachineCreationParams) (object.VirtualDeviceList, error) {
-	finder, err := vs.getFinder()
+func addDisk(ctx context.Context, devices object.VirtualDeviceList, vs *Session, params VirtualMachineCreationParams) (object.VirtualDeviceList, error) {
+	finder, err := vs.getFinder(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	debugf("finder.Datastore(%s)", params.SrcDiskDataStore)
-	diskDatastore, err := finder.Datastore(vs.ctx, params.SrcDiskDataStore)
+	diskDatastore, err := vs.findDatastore(ctx, finder, params.SrcDiskDataStore)
 	if err != nil {
 		return nil, err
 	}
 
-	controller, err := devices.FindDiskController("scsi")
+	controller, err := findDiskController(devices, params.ControllerType)
 	if err != nil {
 		return nil, err
 	}
@@ -314,25 +1715,227 @@ func addDisk(devices object.VirtualDeviceList, vs *Session, params VirtualMachin
 		diskDatastore.Path(params.SrcDiskPath),
 	)
 
+	// some macOS bootloaders only look for the OS disk at the first unit, so
+	// pin it there rather than relying on the order devices are added in.
+	// Data disks are allocated after it and get the following units.
+	for _, device := range devices {
+		d := device.GetVirtualDevice()
+		if d.ControllerKey == disk.ControllerKey && d.UnitNumber != nil && *d.UnitNumber == bootDiskUnitNumber {
+			return nil, fmt.Errorf("unit %d of the disk controller is already in use", bootDiskUnitNumber)
+		}
+	}
+	*disk.UnitNumber = bootDiskUnitNumber
+
+	diskMode, err := parseDiskMode(params.DiskMode)
+	if err != nil {
+		return nil, err
+	}
+
+	thin := true
+	if params.ThinProvisioned != nil {
+		thin = *params.ThinProvisioned
+	}
+
 	backing := disk.Backing.(*types.VirtualDiskFlatVer2BackingInfo)
-	backing.ThinProvisioned = types.NewBool(true)
-	backing.DiskMode = string(types.VirtualDiskModeIndependent_nonpersistent)
+	backing.ThinProvisioned = types.NewBool(thin)
+	backing.DiskMode = string(diskMode)
+
+	if params.DiskSizeGB > 0 {
+		srcCapacityKB, err := vs.diskCapacityKB(ctx, diskDatastore, params.SrcDiskPath)
+		if err != nil {
+			return nil, err
+		}
+		capacityKB := params.DiskSizeGB * 1024 * 1024
+		if capacityKB < srcCapacityKB {
+			return nil, fmt.Errorf("disk size %dGB is smaller than source disk %s (%dKB)",
+				params.DiskSizeGB, params.SrcDiskPath, srcCapacityKB)
+		}
+		debugf("setting disk capacity to %dKB", capacityKB)
+		disk.CapacityInKB = capacityKB
+	}
 
 	return append(devices, disk), nil
 }
 
+// parseDiskMode validates a disk mode, defaulting to independent_nonpersistent
+func parseDiskMode(mode string) (types.VirtualDiskMode, error) {
+	if mode == "" {
+		return types.VirtualDiskModeIndependent_nonpersistent, nil
+	}
+	switch m := types.VirtualDiskMode(mode); m {
+	case types.VirtualDiskModePersistent,
+		types.VirtualDiskModeNonpersistent,
+		types.VirtualDiskModeUndoable,
+		types.VirtualDiskModeIndependent_persistent,
+		types.VirtualDiskModeIndependent_nonpersistent,
+		types.VirtualDiskModeAppend:
+		return m, nil
+	}
+	return "", fmt.Errorf("invalid disk mode %q", mode)
+}
+
+// diskCapacityKB looks up the capacity of a VMDK on a datastore
+func (vs *Session) diskCapacityKB(ctx context.Context, ds *object.Datastore, diskPath string) (int64, error) {
+	browser, err := ds.Browser(ctx)
+	if err != nil {
+		return 0, err
+	}
+	spec := types.HostDatastoreBrowserSearchSpec{
+		Query: []types.BaseFileQuery{
+			&types.VmDiskFileQuery{
+				Details: &types.VmDiskFileQueryFlags{CapacityKb: true},
+			},
+		},
+		MatchPattern: []string{path.Base(diskPath)},
+	}
+	debugf("browser.SearchDatastore(%s)", ds.Path(path.Dir(diskPath)))
+	var info *types.TaskInfo
+	err = vs.withRetry(ctx, "SearchDatastore "+ds.Path(diskPath), func() error {
+		task, err := browser.SearchDatastore(ctx, ds.Path(path.Dir(diskPath)), &spec)
+		if err != nil {
+			return err
+		}
+		info, err = task.WaitForResult(ctx, nil)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	res := info.Result.(types.HostDatastoreBrowserSearchResults)
+	for _, f := range res.File {
+		if disk, ok := f.(*types.VmDiskFileInfo); ok {
+			return disk.CapacityKb, nil
+		}
+	}
+	return 0, fmt.Errorf("source disk %s not found", ds.Path(diskPath))
+}
+
+// createDataDisks returns new empty disks for specs, placed on the same
+// controller as the existing devices' disk at the next free unit numbers
+func createDataDisks(ctx context.Context, devices object.VirtualDeviceList, vs *Session, controllerType string, specs []DiskSpec) (object.VirtualDeviceList, error) {
+	var disks object.VirtualDeviceList
+	if len(specs) == 0 {
+		return disks, nil
+	}
+
+	finder, err := vs.getFinder(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	controller, err := findDiskController(devices, controllerType)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, spec := range specs {
+		if spec.SizeGB <= 0 {
+			return nil, fmt.Errorf("invalid size %dGB for disk on %s", spec.SizeGB, spec.DatastoreName)
+		}
+		eagerlyScrub := spec.EagerlyScrub != nil && *spec.EagerlyScrub
+		if eagerlyScrub && spec.ThinProvisioned {
+			return nil, fmt.Errorf("disk on %s can't be both thin provisioned and eagerly scrubbed", spec.DatastoreName)
+		}
+
+		ds, err := vs.findDatastore(ctx, finder, spec.DatastoreName)
+		if err != nil {
+			return nil, err
+		}
+
+		// allocate unit numbers and keys against all devices so far
+		all := append(append(object.VirtualDeviceList{}, devices...), disks...)
+		disk := all.CreateDisk(controller, ds.Reference(), "")
+		disk.Key = all.NewKey()
+		disk.CapacityInKB = spec.SizeGB * 1024 * 1024
+
+		backing := disk.Backing.(*types.VirtualDiskFlatVer2BackingInfo)
+		backing.FileName = fmt.Sprintf("[%s]", ds.Name())
+		backing.ThinProvisioned = types.NewBool(spec.ThinProvisioned)
+		backing.EagerlyScrub = spec.EagerlyScrub
+
+		debugf("adding %dGB data disk on %s at unit %d", spec.SizeGB, ds.Name(), *disk.UnitNumber)
+		disks = append(disks, disk)
+	}
+
+	return disks, nil
+}
+
 func addUSB(devices object.VirtualDeviceList) (object.VirtualDeviceList, error) {
 	t := true
 	usb := &types.VirtualUSBController{AutoConnectDevices: &t, EhciEnabled: &t}
 	return append(devices, usb), nil
 }
 
-func (vs *Session) getFinder() (*find.Finder, error) {
+// addCDROM adds an IDE CD-ROM with the ISO at isoPath, a datastore path like
+// "[datastore1] iso/config.iso", or nothing when isoPath is empty
+func addCDROM(devices object.VirtualDeviceList, isoPath string) (object.VirtualDeviceList, error) {
+	if isoPath == "" {
+		return devices, nil
+	}
+	var dsPath object.DatastorePath
+	if !dsPath.FromString(isoPath) || dsPath.Path == "" {
+		return nil, fmt.Errorf("invalid ISO datastore path %q, expected \"[datastore] path\"", isoPath)
+	}
+	ide, err := devices.CreateIDEController()
+	if err != nil {
+		return nil, err
+	}
+	devices = append(devices, ide)
+	cdrom, err := devices.CreateCdrom(ide.(*types.VirtualIDEController))
+	if err != nil {
+		return nil, err
+	}
+	debugf("adding cdrom with %s", dsPath.String())
+	return append(devices, devices.InsertIso(cdrom, dsPath.String())), nil
+}
+
+// addSerial adds a serial port listening on uri, e.g. telnet://:13370, or
+// nothing when uri is empty
+func addSerial(devices object.VirtualDeviceList, uri string) (object.VirtualDeviceList, error) {
+	if uri == "" {
+		return devices, nil
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "telnet", "tcp":
+	default:
+		return nil, fmt.Errorf("invalid serial port uri %q, scheme must be telnet or tcp", uri)
+	}
+	port := &types.VirtualSerialPort{YieldOnPoll: true}
+	port.Key = devices.NewKey()
+	port.Connectable = &types.VirtualDeviceConnectInfo{
+		Connected:      true,
+		StartConnected: true,
+	}
+	debugf("adding serial port on %s", uri)
+	return append(devices, devices.ConnectSerialPort(port, uri, false, "")), nil
+}
+
+// SetDatacenter selects the datacenter by name or inventory path, an empty
+// path selects the default datacenter
+func (vs *Session) SetDatacenter(path string) {
+	vs.datacenterPath = path
+	vs.datacenter = nil
+	vs.finder = nil
+	vs.cache.clear()
+}
+
+func (vs *Session) getFinder(ctx context.Context) (*find.Finder, error) {
 	if vs.finder == nil {
 		debugf("find.NewFinder()")
 		finder := find.NewFinder(vs.client.Client, true)
-		debugf("finder.DefaultDatacenter()")
-		dc, err := finder.DefaultDatacenter(vs.ctx)
+		var dc *object.Datacenter
+		var err error
+		if vs.datacenterPath != "" {
+			debugf("finder.Datacenter(%s)", vs.datacenterPath)
+			dc, err = finder.Datacenter(ctx, vs.datacenterPath)
+		} else {
+			debugf("finder.DefaultDatacenter()")
+			dc, err = finder.DefaultDatacenter(ctx)
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -344,8 +1947,35 @@ func (vs *Session) getFinder() (*find.Finder, error) {
 	return vs.finder, nil
 }
 
+// logf is where debugf output goes, log.Printf unless set with SetLogger
+var logf = log.Printf
+
+// SetLogger routes the package's log output to logger, which is passed
+// messages prefixed with [vsphere]. A nil logger restores log.Printf.
+func SetLogger(logger func(format string, args ...interface{})) {
+	if logger == nil {
+		logger = log.Printf
+	}
+	logf = logger
+}
+
+// debug enables routine trace output, see SetDebug
+var debug = true
+
+// SetDebug turns the package's routine trace output on or off, warnings are
+// logged either way
+func SetDebug(enabled bool) {
+	debug = enabled
+}
+
 func debugf(format string, data ...interface{}) {
-	log.Printf("[vsphere] "+format, data...)
+	if debug {
+		logf("[vsphere] "+format, data...)
+	}
+}
+
+func warnf(format string, data ...interface{}) {
+	logf("[vsphere] WARNING "+format, data...)
 }
 
 func isNotAuthenticated(err error) bool {
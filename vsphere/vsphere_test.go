@@ -0,0 +1,92 @@
+package vsphere
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"testing"
+)
+
+func TestListVmkiteVMsNestedFolders(t *testing.T) {
+	f := newFakeVC(t)
+	builds := f.add(f.vmFolder, "Folder", "builds")
+	macos := f.add(builds, "Folder", "macos")
+	f.addVM(f.vmFolder, "vmkite-top", map[string]string{
+		"guestinfo.vmkite-name":   "vmkite-top",
+		"guestinfo.vmkite-job-id": "job-1",
+	})
+	f.addVM(macos, "vmkite-nested", map[string]string{
+		"guestinfo.vmkite-name":   "vmkite-nested",
+		"guestinfo.vmkite-job-id": "job-2",
+	})
+	f.addVM(builds, "template", nil)
+
+	vms, err := f.session().ListVmkiteVMs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, vm := range vms {
+		names = append(names, vm.VmkiteName)
+	}
+	sort.Strings(names)
+	if len(names) != 2 || names[0] != "vmkite-nested" || names[1] != "vmkite-top" {
+		t.Errorf("listed %v, want [vmkite-nested vmkite-top]", names)
+	}
+	if n := f.count("DestroyView"); n != 1 {
+		t.Errorf("destroyed %d container views, want 1", n)
+	}
+}
+
+func TestCreateVMIfNotExistsFindsExistingVM(t *testing.T) {
+	f := newFakeVC(t)
+	builds := f.add(f.vmFolder, "Folder", "builds")
+	f.addVM(builds, "vmkite-1", nil)
+
+	// a new session, before anything has loaded the datacenter
+	vs, logins := newReauthSession(f, true)
+	vs.datacenter, vs.finder = nil, nil
+	f.fail("RetrieveProperties", notAuthenticatedFault())
+
+	params := VirtualMachineCreationParams{Name: "vmkite-1", FolderPath: "builds"}
+	vm, err := vs.CreateVMIfNotExists(context.Background(), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vm.Name != "vmkite-1" {
+		t.Errorf("got vm %s, want vmkite-1", vm.Name)
+	}
+	if *logins != 1 {
+		t.Errorf("logged in %d times, want 1", *logins)
+	}
+	if n := f.count("CreateVM_Task"); n != 0 {
+		t.Errorf("CreateVM_Task called %d times, want 0", n)
+	}
+}
+
+func TestFindVMByJobIDNestedFolder(t *testing.T) {
+	f := newFakeVC(t)
+	builds := f.add(f.vmFolder, "Folder", "builds")
+	f.addVM(f.vmFolder, "vmkite-1", map[string]string{
+		"guestinfo.vmkite-name":   "vmkite-1",
+		"guestinfo.vmkite-job-id": "job-1",
+	})
+	f.addVM(builds, "vmkite-2", map[string]string{
+		"guestinfo.vmkite-name":   "vmkite-2",
+		"guestinfo.vmkite-job-id": "job-2",
+	})
+	vs := f.session()
+	ctx := context.Background()
+
+	vm, err := vs.FindVMByJobID(ctx, "job-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vm.Name != "vmkite-2" {
+		t.Errorf("job-2 found vm %s, want vmkite-2", vm.Name)
+	}
+
+	if _, err := vs.FindVMByJobID(ctx, "job-3"); !errors.Is(err, ErrVirtualMachineNotFound) {
+		t.Errorf("job-3 found with error %v, want ErrVirtualMachineNotFound", err)
+	}
+}